@@ -0,0 +1,167 @@
+// Copyright 2025 Fredrik Steen <fredrik@tty.se>
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// AdminConfig controls access to the admin endpoints
+type AdminConfig struct {
+	// Bearer token required by the admin endpoints, they are disabled
+	// without one
+	Token     string `yaml:"token"`
+	TokenFile string `yaml:"tokenFile"` // read the token from a file instead
+	// Accept loopback clients without the token. Only safe when nothing on
+	// the host, like a sidecar proxy, forwards other clients from loopback.
+	AllowLoopback bool `yaml:"allowLoopback"`
+}
+
+// requireAdmin wraps an admin endpoint, rejecting requests without the
+// configured bearer token, unless loopback clients are allowed
+func (w *Watcher) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		if w.config.Admin.AllowLoopback {
+			if addr, err := netip.ParseAddrPort(r.RemoteAddr); err == nil && addr.Addr().IsLoopback() {
+				next(rw, r)
+				return
+			}
+		}
+
+		token := w.config.Admin.Token
+		if token == "" {
+			msg := "admin endpoints are disabled without an admin token"
+			if w.config.Admin.AllowLoopback {
+				msg = "admin endpoints only accept loopback clients without an admin token"
+			}
+			http.Error(rw, msg, http.StatusForbidden)
+			return
+		}
+
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			rw.Header().Set("WWW-Authenticate", `Bearer realm="k8s-node-external-ip-watcher"`)
+			http.Error(rw, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(rw, r)
+	}
+}
+
+// pause stops applying changes, node events are still tracked. Returns false
+// if already paused.
+func (w *Watcher) pause(source string) bool {
+	if !w.paused.CompareAndSwap(false, true) {
+		return false
+	}
+	applyPaused.Set(1)
+	w.logger.Warn("Applying paused, node changes are tracked but not applied", "source", source)
+	return true
+}
+
+// resume applies the latest node state once and continues applying changes.
+// Returns false if not paused.
+func (w *Watcher) resume(source string) bool {
+	if !w.paused.CompareAndSwap(true, false) {
+		return false
+	}
+	applyPaused.Set(0)
+	w.logger.Info("Applying resumed", "source", source)
+	w.enqueueAll()
+	return true
+}
+
+// trigger forces a render and command of the named target, or every target
+// if name is empty, even if the node data is unchanged
+func (w *Watcher) trigger(name, source string) error {
+	if w.paused.Load() {
+		return fmt.Errorf("applying is paused")
+	}
+
+	targets := w.targets
+	if name != "" {
+		t := w.target(name)
+		if t == nil {
+			return fmt.Errorf("unknown target %q", name)
+		}
+		targets = []*Target{t}
+	}
+
+	for _, t := range targets {
+		w.logger.Info("Forcing apply", "target", t.config.Name, "source", source)
+		t.forceApply.Store(true)
+		t.markPending()
+		w.queue.Add(t.config.Name)
+	}
+	return nil
+}
+
+// handlePause pauses applying
+func (w *Watcher) handlePause(rw http.ResponseWriter, r *http.Request) {
+	if !w.pause("http") {
+		fmt.Fprintln(rw, "already paused")
+		return
+	}
+	fmt.Fprintln(rw, "paused")
+}
+
+// handleResume resumes applying
+func (w *Watcher) handleResume(rw http.ResponseWriter, r *http.Request) {
+	if !w.resume("http") {
+		fmt.Fprintln(rw, "not paused")
+		return
+	}
+	fmt.Fprintln(rw, "resumed")
+}
+
+// handleTrigger forces an apply of the target in the target query
+// parameter, or of every target without one
+func (w *Watcher) handleTrigger(rw http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("target")
+	if err := w.trigger(name, "http"); err != nil {
+		status := http.StatusConflict
+		if name != "" && w.target(name) == nil {
+			status = http.StatusNotFound
+		}
+		http.Error(rw, err.Error(), status)
+		return
+	}
+	if name == "" {
+		fmt.Fprintln(rw, "apply queued for every target")
+		return
+	}
+	fmt.Fprintf(rw, "apply queued for target %s\n", name)
+}
+
+// handleSignals forces an apply of every target on SIGUSR1 and toggles
+// pause on SIGUSR2 until ctx is done
+func (w *Watcher) handleSignals(ctx context.Context) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+	defer signal.Stop(signals)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case sig := <-signals:
+			switch sig {
+			case syscall.SIGUSR1:
+				if err := w.trigger("", "SIGUSR1"); err != nil {
+					w.logger.Warn("Ignoring forced apply", "source", "SIGUSR1", "error", err)
+				}
+			case syscall.SIGUSR2:
+				if !w.pause("SIGUSR2") {
+					w.resume("SIGUSR2")
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPauseResume(t *testing.T) {
+	target := newTestTarget(t, "ips", "{{ range .AllIPs }}{{ . }}\n{{ end }}")
+	w := newTestWatcher(target)
+	defer w.queue.ShutDown()
+
+	w.handleNodeEvent("ADD", newTestNode("node1", "1.2.3.4"))
+	processQueue(w)
+
+	if !w.pause("test") || w.pause("test") {
+		t.Fatal("expected only the first pause to succeed")
+	}
+	w.handleNodeEvent("ADD", newTestNode("node2", "5.6.7.8"))
+	processQueue(w)
+
+	got, _ := os.ReadFile(target.config.OutputPath)
+	if string(got) != "1.2.3.4\n" {
+		t.Errorf("expected output unchanged while paused, got %q", got)
+	}
+	if err := w.trigger("", "test"); err == nil {
+		t.Error("expected forced apply to fail while paused")
+	}
+
+	if !w.resume("test") || w.resume("test") {
+		t.Fatal("expected only the first resume to succeed")
+	}
+	processQueue(w)
+
+	got, _ = os.ReadFile(target.config.OutputPath)
+	if string(got) != "1.2.3.4\n5.6.7.8\n" {
+		t.Errorf("expected latest state applied on resume, got %q", got)
+	}
+}
+
+func TestTrigger(t *testing.T) {
+	dir := t.TempDir()
+	runsFile := filepath.Join(dir, "runs")
+	target := newTestTarget(t, "ips", "{{ len .Nodes }}")
+	setCommand(t, target, writeScript(t, dir, "reload.sh", `echo "$WATCHER_TRIGGER" >> `+runsFile))
+	w := newTestWatcher(target)
+	defer w.queue.ShutDown()
+
+	w.handleNodeEvent("ADD", newTestNode("node1", "1.2.3.4"))
+	processQueue(w)
+
+	// Unchanged data is not applied again unless forced
+	w.enqueueAll()
+	processQueue(w)
+
+	rec := httptest.NewRecorder()
+	w.handleTrigger(rec, httptest.NewRequest(http.MethodPost, "/trigger?target=ips", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected trigger to succeed, got %d: %s", rec.Code, rec.Body.String())
+	}
+	processQueue(w)
+
+	got, _ := os.ReadFile(runsFile)
+	if string(got) != "initial\nmanual\n" {
+		t.Errorf("expected initial and manual runs, got %q", got)
+	}
+
+	rec = httptest.NewRecorder()
+	w.handleTrigger(rec, httptest.NewRequest(http.MethodPost, "/trigger?target=missing", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown target, got %d", rec.Code)
+	}
+}
+
+func TestRequireAdmin(t *testing.T) {
+	ok := func(rw http.ResponseWriter, r *http.Request) {}
+
+	tests := []struct {
+		name          string
+		token         string
+		allowLoopback bool
+		remoteAddr    string
+		auth          string
+		want          int
+	}{
+		{"no token configured", "", false, "127.0.0.1:40000", "Bearer secret", http.StatusForbidden},
+		{"valid token", "secret", false, "192.0.2.1:40000", "Bearer secret", http.StatusOK},
+		{"wrong token", "secret", false, "192.0.2.1:40000", "Bearer wrong", http.StatusUnauthorized},
+		{"missing token", "secret", false, "192.0.2.1:40000", "", http.StatusUnauthorized},
+		{"loopback not trusted by default", "secret", false, "127.0.0.1:40000", "", http.StatusUnauthorized},
+		{"loopback allowed", "", true, "127.0.0.1:40000", "", http.StatusOK},
+		{"IPv6 loopback allowed", "", true, "[::1]:40000", "", http.StatusOK},
+		{"remote with loopback allowed", "", true, "192.0.2.1:40000", "", http.StatusForbidden},
+		{"remote with loopback allowed needs the token", "secret", true, "192.0.2.1:40000", "", http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := newTestWatcher()
+			w.config.Admin.Token = tt.token
+			w.config.Admin.AllowLoopback = tt.allowLoopback
+
+			req := httptest.NewRequest(http.MethodPost, "/pause", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			rec := httptest.NewRecorder()
+			w.requireAdmin(ok)(rec, req)
+
+			if rec.Code != tt.want {
+				t.Errorf("expected %d, got %d: %s", tt.want, rec.Code, strings.TrimSpace(rec.Body.String()))
+			}
+		})
+	}
+}
@@ -0,0 +1,297 @@
+// Copyright 2025 Fredrik Steen <fredrik@tty.se>
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Reasons an apply was triggered, passed to commands as WATCHER_TRIGGER
+const (
+	triggerInitial  = "initial"  // first apply of the target
+	triggerChange   = "change"   // node data changed
+	triggerRetry    = "retry"    // retry after a failed apply
+	triggerRollback = "rollback" // previous data restored after a failed health check
+	triggerManual   = "manual"   // forced through /trigger or SIGUSR1
+)
+
+// Data fed to commands on stdin for TargetConfig.CommandStdin
+const (
+	stdinOutput = "output" // the rendered template
+	stdinJSON   = "json"   // CommandData as JSON
+)
+
+// CommandLine is the command of a target. In YAML it is either a single
+// path, run with the output file as its only argument, or an argv list whose
+// elements are templates rendered with CommandData.
+type CommandLine []string
+
+// UnmarshalYAML accepts a single command path or an argv list
+func (c *CommandLine) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		var path string
+		if err := value.Decode(&path); err != nil {
+			return err
+		}
+		*c = CommandLine{path, "{{ .OutputPath }}"}
+		return nil
+	}
+
+	var argv []string
+	if err := value.Decode(&argv); err != nil {
+		return err
+	}
+	*c = argv
+	return nil
+}
+
+// parseArgs parses every argument of the command line as a template
+func (c CommandLine) parseArgs() ([]*template.Template, error) {
+	args := make([]*template.Template, 0, len(c))
+	for i, arg := range c {
+		tmpl, err := template.New(fmt.Sprintf("arg%d", i)).
+			Funcs(templateFuncs()).
+			Option("missingkey=error").
+			Parse(arg)
+		if err != nil {
+			return nil, fmt.Errorf("parse command argument %d: %w", i, err)
+		}
+		args = append(args, tmpl)
+	}
+	return args, nil
+}
+
+// CommandData is the template data of command arguments, and the document
+// fed to commands with commandStdin json
+type CommandData struct {
+	NodeData   `json:"data"`
+	Target     string `json:"target"`     // target name
+	OutputPath string `json:"outputPath"` // empty with skipOutput
+	Hash       string `json:"hash"`       // hash of the rendered node data
+	Trigger    string `json:"trigger"`    // initial, change, retry, rollback or manual
+	Change     Change `json:"change"`     // what changed since the last applied data
+}
+
+// Change describes what changed between two applied node data sets
+type Change struct {
+	Added      []string `json:"added"`      // names of added nodes
+	Removed    []string `json:"removed"`    // names of removed nodes
+	Changed    []string `json:"changed"`    // names of nodes with changed addresses
+	AddedIPs   []string `json:"addedIPs"`   // addresses in AllIPs that are new
+	RemovedIPs []string `json:"removedIPs"` // addresses no longer in AllIPs
+}
+
+// diffNodeData returns the change from the old to the new node data
+func diffNodeData(old, new NodeData) Change {
+	var c Change
+
+	oldNodes := make(map[string]NodeInfo, len(old.Nodes))
+	for _, node := range old.Nodes {
+		oldNodes[node.Name] = node
+	}
+
+	for _, node := range new.Nodes {
+		prev, ok := oldNodes[node.Name]
+		switch {
+		case !ok:
+			c.Added = append(c.Added, node.Name)
+		case !slices.Equal(prev.Addresses, node.Addresses):
+			c.Changed = append(c.Changed, node.Name)
+		}
+		delete(oldNodes, node.Name)
+	}
+	for name := range oldNodes {
+		c.Removed = append(c.Removed, name)
+	}
+	slices.Sort(c.Added)
+	slices.Sort(c.Removed)
+	slices.Sort(c.Changed)
+
+	c.AddedIPs = subtractStrings(new.AllIPs, old.AllIPs)
+	c.RemovedIPs = subtractStrings(old.AllIPs, new.AllIPs)
+
+	return c
+}
+
+// subtractStrings returns the elements of a that are not in b
+func subtractStrings(a, b []string) []string {
+	var out []string
+	for _, s := range a {
+		if !slices.Contains(b, s) {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// renderArgs renders the command line templates into argv
+func renderArgs(args []*template.Template, data CommandData) ([]string, error) {
+	argv := make([]string, 0, len(args))
+	for i, tmpl := range args {
+		var b strings.Builder
+		if err := tmpl.Execute(&b, data); err != nil {
+			return nil, fmt.Errorf("render command argument %d: %w", i, err)
+		}
+		argv = append(argv, b.String())
+	}
+	return argv, nil
+}
+
+// commandEnv returns the environment variables describing the apply
+func commandEnv(data CommandData) []string {
+	return []string{
+		"WATCHER_TARGET=" + data.Target,
+		"WATCHER_OUTPUT=" + data.OutputPath,
+		"WATCHER_HASH=" + data.Hash,
+		"WATCHER_TRIGGER=" + data.Trigger,
+		"WATCHER_NODE_COUNT=" + strconv.Itoa(len(data.Nodes)),
+		"WATCHER_ADDED_NODES=" + strings.Join(data.Change.Added, " "),
+		"WATCHER_REMOVED_NODES=" + strings.Join(data.Change.Removed, " "),
+		"WATCHER_CHANGED_NODES=" + strings.Join(data.Change.Changed, " "),
+		"WATCHER_ADDED_IPS=" + strings.Join(data.Change.AddedIPs, " "),
+		"WATCHER_REMOVED_IPS=" + strings.Join(data.Change.RemovedIPs, " "),
+	}
+}
+
+// commandStdin returns the standard input of the command for the stdin mode,
+// nil if the command gets none
+func commandStdin(mode string, output []byte, data CommandData) ([]byte, error) {
+	switch mode {
+	case stdinOutput:
+		return output, nil
+	case stdinJSON:
+		b, err := json.Marshal(data)
+		if err != nil {
+			return nil, fmt.Errorf("encode command stdin: %w", err)
+		}
+		return append(b, '\n'), nil
+	}
+	return nil, nil
+}
+
+// validateOutput runs the validate command, if any, against the rendered
+// temporary file, passed as .OutputPath and WATCHER_OUTPUT
+func (w *Watcher) validateOutput(ctx context.Context, t *Target, data CommandData, tmpPath string) error {
+	if len(t.validate) == 0 {
+		return nil
+	}
+
+	data.OutputPath = tmpPath
+	if err := w.runCommand(ctx, t, t.validate, data, nil); err != nil {
+		validationsTotal.WithLabelValues(t.config.Name, "failure").Inc()
+		return fmt.Errorf("validate output: %w", err)
+	}
+
+	validationsTotal.WithLabelValues(t.config.Name, "success").Inc()
+	return nil
+}
+
+// healthCheck runs the health check command, if any, after the command
+func (w *Watcher) healthCheck(ctx context.Context, t *Target, data CommandData) error {
+	if len(t.health) == 0 {
+		return nil
+	}
+
+	if err := w.runCommand(ctx, t, t.health, data, nil); err != nil {
+		healthChecksTotal.WithLabelValues(t.config.Name, "failure").Inc()
+		return fmt.Errorf("health check: %w", err)
+	}
+
+	healthChecksTotal.WithLabelValues(t.config.Name, "success").Inc()
+	return nil
+}
+
+// previousOutput returns the state to roll back to: the last applied
+// render, before the first apply the latest kept version, or else the current
+// output file without node data. The output file is not used once applied, it
+// may hold a render whose command failed. Must be called with t.mu held.
+func (w *Watcher) previousOutput(t *Target) (*appliedOutput, bool) {
+	if applied := t.applied.Load(); applied != nil {
+		return applied, true
+	}
+
+	latest, err := t.latestVersion()
+	if err != nil {
+		w.logger.Warn("Failed to read latest backup", "target", t.config.Name, "error", err)
+	}
+	if latest != nil {
+		return latest, true
+	}
+
+	if t.config.skipOutput() {
+		return nil, false
+	}
+	b, err := os.ReadFile(t.config.OutputPath)
+	if err != nil {
+		return nil, false
+	}
+	return &appliedOutput{Output: b}, true
+}
+
+// errRolledBack marks node data that was rolled back after a failed health
+// check. It is not retried until the node data changes or an apply is forced.
+var errRolledBack = errors.New("rolled back to previous output")
+
+// rollback restores the previous output and re-runs the command with the
+// node data it was applied with. Must be called with t.mu held.
+func (w *Watcher) rollback(ctx context.Context, t *Target, failed CommandData, previous *appliedOutput) error {
+	w.logger.Warn("Health check failed, rolling back to previous output", "target", t.config.Name)
+
+	err := w.restoreOutput(ctx, t, failed, previous)
+	if err != nil {
+		rollbacksTotal.WithLabelValues(t.config.Name, "failure").Inc()
+		return err
+	}
+
+	rollbacksTotal.WithLabelValues(t.config.Name, "success").Inc()
+	return nil
+}
+
+// restoreOutput writes the previous output back and runs the command with
+// its node data. An output file read without node data is only written back,
+// there is nothing to run the command with.
+func (w *Watcher) restoreOutput(ctx context.Context, t *Target, failed CommandData, previous *appliedOutput) error {
+	if !t.config.skipOutput() {
+		tmpPath, err := t.renderTemp(func(out io.Writer) error {
+			_, err := out.Write(previous.Output)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if err := t.commitOutput(tmpPath); err != nil {
+			return err
+		}
+	}
+	w.logDiff(t, t.lastRendered, previous.Output)
+	t.lastRendered = previous.Output
+
+	if previous.Hash == "" {
+		w.logger.Warn("No applied node data to roll back to, restored the output without running the command", "target", t.config.Name)
+		return nil
+	}
+
+	data := CommandData{
+		NodeData:   previous.Data,
+		Target:     t.config.Name,
+		OutputPath: t.config.OutputPath,
+		Hash:       previous.Hash,
+		Trigger:    triggerRollback,
+		Change:     diffNodeData(failed.NodeData, previous.Data),
+	}
+	stdin, err := commandStdin(t.config.CommandStdin, previous.Output, data)
+	if err != nil {
+		return err
+	}
+	return w.executeCommand(ctx, t, data, stdin)
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestCommandLineUnmarshal(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		want CommandLine
+	}{
+		{"path gets output file", "command: /usr/sbin/reload", CommandLine{"/usr/sbin/reload", "{{ .OutputPath }}"}},
+		{"argv list is kept", "command: [nginx, -s, reload]", CommandLine{"nginx", "-s", "reload"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg TargetConfig
+			if err := yaml.Unmarshal([]byte(tt.yaml), &cfg); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !slices.Equal(cfg.Command, tt.want) {
+				t.Errorf("expected %q, got %q", tt.want, cfg.Command)
+			}
+		})
+	}
+}
+
+func TestDiffNodeData(t *testing.T) {
+	old := NodeData{
+		Nodes: []NodeInfo{
+			{Name: "node1", Addresses: []string{"1.1.1.1"}},
+			{Name: "node2", Addresses: []string{"2.2.2.2"}},
+		},
+		AllIPs: []string{"1.1.1.1", "2.2.2.2"},
+	}
+	updated := NodeData{
+		Nodes: []NodeInfo{
+			{Name: "node1", Addresses: []string{"1.1.1.9"}},
+			{Name: "node3", Addresses: []string{"3.3.3.3"}},
+		},
+		AllIPs: []string{"1.1.1.9", "3.3.3.3"},
+	}
+
+	c := diffNodeData(old, updated)
+	if !slices.Equal(c.Added, []string{"node3"}) {
+		t.Errorf("unexpected added nodes %v", c.Added)
+	}
+	if !slices.Equal(c.Removed, []string{"node2"}) {
+		t.Errorf("unexpected removed nodes %v", c.Removed)
+	}
+	if !slices.Equal(c.Changed, []string{"node1"}) {
+		t.Errorf("unexpected changed nodes %v", c.Changed)
+	}
+	if !slices.Equal(c.AddedIPs, []string{"1.1.1.9", "3.3.3.3"}) {
+		t.Errorf("unexpected added IPs %v", c.AddedIPs)
+	}
+	if !slices.Equal(c.RemovedIPs, []string{"1.1.1.1", "2.2.2.2"}) {
+		t.Errorf("unexpected removed IPs %v", c.RemovedIPs)
+	}
+}
+
+func TestCommandArgsAndEnv(t *testing.T) {
+	target := newTestTarget(t, "ips", "{{ len .Nodes }}")
+	dir := filepath.Dir(target.config.OutputPath)
+	argsFile := filepath.Join(dir, "args")
+	envFile := filepath.Join(dir, "env")
+	script := writeScript(t, dir, "reload.sh", `echo "$@" > `+argsFile+"\nenv | grep ^WATCHER_ | sort > "+envFile)
+	setCommand(t, target, script, "--target={{ .Target }}", "{{ .AllIPs | join \",\" }}")
+
+	w := newTestWatcher(target)
+	w.handleNodeEvent("ADD", newTestNode("node1", "1.2.3.4"))
+	processQueue(w)
+
+	args, err := os.ReadFile(argsFile)
+	if err != nil {
+		t.Fatalf("failed to read args: %v", err)
+	}
+	if got := strings.TrimSpace(string(args)); got != "--target=ips 1.2.3.4" {
+		t.Errorf("unexpected args %q", got)
+	}
+
+	readEnv := func() string {
+		t.Helper()
+		env, err := os.ReadFile(envFile)
+		if err != nil {
+			t.Fatalf("failed to read env: %v", err)
+		}
+		return string(env)
+	}
+
+	env := readEnv()
+	for _, want := range []string{
+		"WATCHER_TARGET=ips",
+		"WATCHER_OUTPUT=" + target.config.OutputPath,
+		"WATCHER_TRIGGER=initial",
+		"WATCHER_NODE_COUNT=1",
+		"WATCHER_ADDED_NODES=node1",
+		"WATCHER_ADDED_IPS=1.2.3.4",
+	} {
+		if !strings.Contains(env, want+"\n") {
+			t.Errorf("expected %s in environment:\n%s", want, env)
+		}
+	}
+
+	w.handleNodeEvent("DELETE", newTestNode("node1", "1.2.3.4"))
+	w.handleNodeEvent("ADD", newTestNode("node2", "5.6.7.8"))
+	processQueue(w)
+
+	env = readEnv()
+	for _, want := range []string{
+		"WATCHER_TRIGGER=change",
+		"WATCHER_ADDED_NODES=node2",
+		"WATCHER_REMOVED_NODES=node1",
+		"WATCHER_REMOVED_IPS=1.2.3.4",
+	} {
+		if !strings.Contains(env, want+"\n") {
+			t.Errorf("expected %s in environment:\n%s", want, env)
+		}
+	}
+}
+
+func TestCommandArgRenderError(t *testing.T) {
+	target := newTestTarget(t, "ips", "{{ len .Nodes }}")
+	setCommand(t, target, "/bin/true", "{{ .Missing }}")
+
+	w := newTestWatcher(target)
+	w.handleNodeEvent("ADD", newTestNode("node1", "1.2.3.4"))
+	processQueue(w)
+
+	target.mu.Lock()
+	defer target.mu.Unlock()
+	if target.appliedHash != "" {
+		t.Error("expected failed argument rendering to leave the change pending")
+	}
+}
+
+func TestCommandStdin(t *testing.T) {
+	t.Run("rendered output without output file", func(t *testing.T) {
+		target := newTestTarget(t, "ips", "{{ range .AllIPs }}{{ . }}\n{{ end }}")
+		dir := filepath.Dir(target.config.OutputPath)
+		stdinFile := filepath.Join(dir, "stdin")
+		setCommand(t, target, writeScript(t, dir, "reload.sh", "cat > "+stdinFile))
+		skip := true
+		target.config.SkipOutput = &skip
+		target.config.CommandStdin = stdinOutput
+
+		w := newTestWatcher(target)
+		w.handleNodeEvent("ADD", newTestNode("node1", "1.2.3.4"))
+		processQueue(w)
+
+		got, err := os.ReadFile(stdinFile)
+		if err != nil {
+			t.Fatalf("failed to read stdin: %v", err)
+		}
+		if string(got) != "1.2.3.4\n" {
+			t.Errorf("unexpected stdin %q", string(got))
+		}
+		if _, err := os.Stat(target.config.OutputPath); !os.IsNotExist(err) {
+			t.Error("expected no output file with skipOutput")
+		}
+	})
+
+	t.Run("json change set", func(t *testing.T) {
+		target := newTestTarget(t, "ips", "{{ len .Nodes }}")
+		dir := filepath.Dir(target.config.OutputPath)
+		stdinFile := filepath.Join(dir, "stdin")
+		setCommand(t, target, writeScript(t, dir, "reload.sh", "cat > "+stdinFile))
+		target.config.CommandStdin = stdinJSON
+
+		w := newTestWatcher(target)
+		w.handleNodeEvent("ADD", newTestNode("node1", "1.2.3.4"))
+		processQueue(w)
+		w.handleNodeEvent("ADD", newTestNode("node2", "5.6.7.8"))
+		processQueue(w)
+
+		b, err := os.ReadFile(stdinFile)
+		if err != nil {
+			t.Fatalf("failed to read stdin: %v", err)
+		}
+		var got CommandData
+		if err := json.Unmarshal(b, &got); err != nil {
+			t.Fatalf("failed to decode stdin: %v", err)
+		}
+		if got.Target != "ips" || got.Trigger != triggerChange || len(got.Nodes) != 2 {
+			t.Errorf("unexpected document %+v", got)
+		}
+		if !bytes.Contains(b, []byte(`"data":{"nodes":[{"name":"node1"`)) {
+			t.Errorf("expected lowercase node data keys, got %s", b)
+		}
+		if !slices.Equal(got.Change.Added, []string{"node2"}) || !slices.Equal(got.Change.AddedIPs, []string{"5.6.7.8"}) {
+			t.Errorf("unexpected change %+v", got.Change)
+		}
+	})
+}
+
+func TestValidateCommand(t *testing.T) {
+	target := newTestTarget(t, "ips", "{{ range .AllIPs }}{{ . }}\n{{ end }}")
+	dir := filepath.Dir(target.config.OutputPath)
+	// Reject output containing 10.0.0.1
+	script := writeScript(t, dir, "validate.sh", `! grep -q 10.0.0.1 "$1"`)
+	validate, err := CommandLine{script, "{{ .OutputPath }}"}.parseArgs()
+	if err != nil {
+		t.Fatalf("failed to parse validate command: %v", err)
+	}
+	target.validate = validate
+
+	w := newTestWatcher(target)
+	defer w.queue.ShutDown()
+	w.handleNodeEvent("ADD", newTestNode("node1", "1.2.3.4"))
+	processQueue(w)
+	w.handleNodeEvent("ADD", newTestNode("node2", "10.0.0.1"))
+	processQueue(w)
+
+	got, err := os.ReadFile(target.config.OutputPath)
+	if err != nil {
+		t.Fatalf("failed to read output: %v", err)
+	}
+	if string(got) != "1.2.3.4\n" {
+		t.Errorf("expected invalid output to be rejected, got %q", string(got))
+	}
+
+	entries, _ := filepath.Glob(filepath.Join(dir, ".ips.out.tmp-*"))
+	if len(entries) != 0 {
+		t.Errorf("expected rejected temp file to be removed, found %v", entries)
+	}
+}
+
+func TestHealthCheckRollback(t *testing.T) {
+	target := newTestTarget(t, "ips", "{{ range .AllIPs }}{{ . }}\n{{ end }}")
+	dir := filepath.Dir(target.config.OutputPath)
+	runsFile := filepath.Join(dir, "runs")
+	setCommand(t, target, writeScript(t, dir, "reload.sh", `echo "$WATCHER_TRIGGER" >> `+runsFile))
+	// Unhealthy once the output contains 10.0.0.1
+	health, err := CommandLine{writeScript(t, dir, "health.sh", `! grep -q 10.0.0.1 "$1"`), "{{ .OutputPath }}"}.parseArgs()
+	if err != nil {
+		t.Fatalf("failed to parse health check command: %v", err)
+	}
+	target.health = health
+
+	w := newTestWatcher(target)
+	defer w.queue.ShutDown()
+	w.handleNodeEvent("ADD", newTestNode("node1", "1.2.3.4"))
+	processQueue(w)
+
+	target.mu.Lock()
+	appliedHash := target.appliedHash
+	target.mu.Unlock()
+
+	w.handleNodeEvent("ADD", newTestNode("node2", "10.0.0.1"))
+	processQueue(w)
+
+	got, err := os.ReadFile(target.config.OutputPath)
+	if err != nil {
+		t.Fatalf("failed to read output: %v", err)
+	}
+	if string(got) != "1.2.3.4\n" {
+		t.Errorf("expected previous output to be restored, got %q", string(got))
+	}
+
+	runs, err := os.ReadFile(runsFile)
+	if err != nil {
+		t.Fatalf("failed to read runs: %v", err)
+	}
+	if string(runs) != "initial\nchange\nrollback\n" {
+		t.Errorf("expected command to re-run after rollback, got runs %q", string(runs))
+	}
+
+	target.mu.Lock()
+	pending := target.appliedHash == appliedHash && target.desiredHash != appliedHash
+	target.mu.Unlock()
+	if !pending {
+		t.Error("expected the unhealthy change to stay pending")
+	}
+	if target.status().LastError == "" {
+		t.Error("expected the rollback in the last error")
+	}
+
+	// The rolled back node data is not retried
+	if err := w.reconcile(context.Background(), "ips", triggerRetry); !errors.Is(err, errRolledBack) {
+		t.Errorf("expected the retry to be skipped, got %v", err)
+	}
+	if w.queue.NumRequeues("ips") != 0 {
+		t.Error("expected no retry to be scheduled")
+	}
+
+	// A forced apply tries it again
+	if err := w.trigger("ips", "test"); err != nil {
+		t.Fatalf("failed to trigger: %v", err)
+	}
+	processQueue(w)
+
+	runs, err = os.ReadFile(runsFile)
+	if err != nil {
+		t.Fatalf("failed to read runs: %v", err)
+	}
+	if string(runs) != "initial\nchange\nrollback\nmanual\nrollback\n" {
+		t.Errorf("expected only the forced apply to re-run the command, got runs %q", string(runs))
+	}
+}
+
+func TestHealthCheckRollbackFirstApply(t *testing.T) {
+	setup := func(t *testing.T) (*Target, string) {
+		target := newTestTarget(t, "ips", "{{ range .AllIPs }}{{ . }}\n{{ end }}")
+		dir := filepath.Dir(target.config.OutputPath)
+		runsFile := filepath.Join(dir, "runs")
+		setCommand(t, target, writeScript(t, dir, "reload.sh", `echo "$WATCHER_TRIGGER $WATCHER_NODE_COUNT" >> `+runsFile))
+		health, err := CommandLine{writeScript(t, dir, "health.sh", `! grep -q 10.0.0.1 "$1"`), "{{ .OutputPath }}"}.parseArgs()
+		if err != nil {
+			t.Fatalf("failed to parse health check command: %v", err)
+		}
+		target.health = health
+		if err := os.WriteFile(target.config.OutputPath, []byte("1.2.3.4\n"), 0o644); err != nil {
+			t.Fatalf("failed to write output: %v", err)
+		}
+		return target, runsFile
+	}
+
+	check := func(t *testing.T, target *Target, runsFile, wantRuns string) {
+		t.Helper()
+		w := newTestWatcher(target)
+		defer w.queue.ShutDown()
+		w.handleNodeEvent("ADD", newTestNode("node1", "10.0.0.1"))
+		processQueue(w)
+
+		got, err := os.ReadFile(target.config.OutputPath)
+		if err != nil {
+			t.Fatalf("failed to read output: %v", err)
+		}
+		if string(got) != "1.2.3.4\n" {
+			t.Errorf("expected previous output to be restored, got %q", string(got))
+		}
+		runs, err := os.ReadFile(runsFile)
+		if err != nil {
+			t.Fatalf("failed to read runs: %v", err)
+		}
+		if string(runs) != wantRuns {
+			t.Errorf("expected runs %q, got %q", wantRuns, string(runs))
+		}
+	}
+
+	t.Run("output file only restores the file", func(t *testing.T) {
+		target, runsFile := setup(t)
+		check(t, target, runsFile, "initial 1\n")
+	})
+
+	t.Run("latest kept version re-runs the command", func(t *testing.T) {
+		target, runsFile := setup(t)
+		backupCount := 2
+		target.config.BackupCount = &backupCount
+		data := NodeData{Nodes: []NodeInfo{{Name: "node0", ExternalIP: "1.2.3.4"}}, AllIPs: []string{"1.2.3.4"}}
+		if err := target.saveVersion("kept", data, []byte("1.2.3.4\n")); err != nil {
+			t.Fatalf("failed to save version: %v", err)
+		}
+		check(t, target, runsFile, "initial 1\nrollback 1\n")
+	})
+}
+
+func TestHealthCheckRollbackAfterFailedCommand(t *testing.T) {
+	target := newTestTarget(t, "ips", "{{ range .AllIPs }}{{ . }}\n{{ end }}")
+	dir := filepath.Dir(target.config.OutputPath)
+	failedFile := filepath.Join(dir, "failed")
+	// Fails the first change, leaving the new output written but not applied
+	setCommand(t, target, writeScript(t, dir, "reload.sh",
+		`[ "$WATCHER_TRIGGER" = change ] && [ ! -e `+failedFile+` ] && touch `+failedFile+` && exit 1; exit 0`))
+	health, err := CommandLine{writeScript(t, dir, "health.sh", `! grep -q 10.0.0.1 "$1"`), "{{ .OutputPath }}"}.parseArgs()
+	if err != nil {
+		t.Fatalf("failed to parse health check command: %v", err)
+	}
+	target.health = health
+
+	w := newTestWatcher(target)
+	defer w.queue.ShutDown()
+	w.handleNodeEvent("ADD", newTestNode("node1", "1.2.3.4"))
+	processQueue(w)
+
+	w.handleNodeEvent("ADD", newTestNode("node2", "10.0.0.1"))
+	processQueue(w)
+	if _, err := os.Stat(failedFile); err != nil {
+		t.Fatal("expected the command to fail on the change")
+	}
+
+	if err := w.reconcile(context.Background(), "ips", triggerRetry); err == nil {
+		t.Fatal("expected the retry to fail the health check")
+	}
+
+	got, err := os.ReadFile(target.config.OutputPath)
+	if err != nil {
+		t.Fatalf("failed to read output: %v", err)
+	}
+	if string(got) != "1.2.3.4\n" {
+		t.Errorf("expected last applied output to be restored, got %q", string(got))
+	}
+}
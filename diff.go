@@ -0,0 +1,227 @@
+// Copyright 2025 Fredrik Steen <fredrik@tty.se>
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// diffContext is the number of unchanged lines around changes in a hunk
+const diffContext = 3
+
+// maxDiffCells bounds the LCS table, larger changes are shown as a
+// replacement of every changed line
+const maxDiffCells = 4_000_000
+
+// outputDiff is the diff of the last render that changed the output
+type outputDiff struct {
+	Time time.Time
+	Text string
+}
+
+// diffOp is a line of an edit script: ' ' unchanged, '-' removed, '+' added
+type diffOp struct {
+	kind byte
+	line string
+}
+
+// unifiedDiff returns the unified diff from old to new, empty if equal.
+// Both sides are labelled with name, usually the output path.
+func unifiedDiff(name string, old, new []byte) string {
+	ops := diffLines(splitLines(string(old)), splitLines(string(new)))
+
+	var changes []int
+	for i, op := range ops {
+		if op.kind != ' ' {
+			changes = append(changes, i)
+		}
+	}
+	if len(changes) == 0 {
+		return ""
+	}
+
+	// Line numbers before each op on both sides
+	oldBefore := make([]int, len(ops)+1)
+	newBefore := make([]int, len(ops)+1)
+	for i, op := range ops {
+		oldBefore[i+1], newBefore[i+1] = oldBefore[i], newBefore[i]
+		if op.kind != '+' {
+			oldBefore[i+1]++
+		}
+		if op.kind != '-' {
+			newBefore[i+1]++
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "--- %s\tprevious\n+++ %s\tnew\n", name, name)
+
+	writeHunk := func(first, last int) {
+		start := max(0, first-diffContext)
+		end := min(len(ops), last+diffContext+1)
+		oldCount := oldBefore[end] - oldBefore[start]
+		newCount := newBefore[end] - newBefore[start]
+		fmt.Fprintf(&b, "@@ -%s +%s @@\n",
+			hunkRange(oldBefore[start], oldCount), hunkRange(newBefore[start], newCount))
+		for _, op := range ops[start:end] {
+			b.WriteByte(op.kind)
+			b.WriteString(op.line)
+			b.WriteByte('\n')
+		}
+	}
+
+	first, last := changes[0], changes[0]
+	for _, c := range changes[1:] {
+		if c-last > 2*diffContext {
+			writeHunk(first, last)
+			first = c
+		}
+		last = c
+	}
+	writeHunk(first, last)
+
+	return b.String()
+}
+
+// hunkRange formats the start line and count of a hunk side
+func hunkRange(before, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", before)
+	}
+	return fmt.Sprintf("%d,%d", before+1, count)
+}
+
+// splitLines splits s into lines without their line endings
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// diffLines returns an edit script turning a into b. Common leading and
+// trailing lines are trimmed before computing the longest common
+// subsequence of the rest.
+func diffLines(a, b []string) []diffOp {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	ops := make([]diffOp, 0, len(a)+len(b))
+	for _, line := range a[:prefix] {
+		ops = append(ops, diffOp{' ', line})
+	}
+
+	ma, mb := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	n, m := len(ma), len(mb)
+	if n*m > maxDiffCells {
+		for _, line := range ma {
+			ops = append(ops, diffOp{'-', line})
+		}
+		for _, line := range mb {
+			ops = append(ops, diffOp{'+', line})
+		}
+	} else {
+		// lcs[i*(m+1)+j] is the LCS length of ma[i:] and mb[j:]
+		lcs := make([]int32, (n+1)*(m+1))
+		for i := n - 1; i >= 0; i-- {
+			for j := m - 1; j >= 0; j-- {
+				if ma[i] == mb[j] {
+					lcs[i*(m+1)+j] = lcs[(i+1)*(m+1)+j+1] + 1
+				} else {
+					lcs[i*(m+1)+j] = max(lcs[(i+1)*(m+1)+j], lcs[i*(m+1)+j+1])
+				}
+			}
+		}
+
+		i, j := 0, 0
+		for i < n && j < m {
+			switch {
+			case ma[i] == mb[j]:
+				ops = append(ops, diffOp{' ', ma[i]})
+				i++
+				j++
+			case lcs[(i+1)*(m+1)+j] >= lcs[i*(m+1)+j+1]:
+				ops = append(ops, diffOp{'-', ma[i]})
+				i++
+			default:
+				ops = append(ops, diffOp{'+', mb[j]})
+				j++
+			}
+		}
+		for ; i < n; i++ {
+			ops = append(ops, diffOp{'-', ma[i]})
+		}
+		for ; j < m; j++ {
+			ops = append(ops, diffOp{'+', mb[j]})
+		}
+	}
+
+	for _, line := range a[len(a)-suffix:] {
+		ops = append(ops, diffOp{' ', line})
+	}
+	return ops
+}
+
+// truncateDiff cuts a diff at a line boundary to at most maxBytes
+func truncateDiff(diff string, maxBytes int) string {
+	if maxBytes <= 0 || len(diff) <= maxBytes {
+		return diff
+	}
+	cut := strings.LastIndexByte(diff[:maxBytes], '\n') + 1
+	return fmt.Sprintf("%s... truncated, %d of %d bytes shown\n", diff[:cut], cut, len(diff))
+}
+
+// handleDiff serves the last output diff of the target in the target query
+// parameter, or of every target
+func (w *Watcher) handleDiff(rw http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("target")
+
+	var b strings.Builder
+	found := false
+	for _, t := range w.targets {
+		if name != "" && t.config.Name != name {
+			continue
+		}
+		found = true
+		if d := t.lastDiff.Load(); d != nil {
+			fmt.Fprintf(&b, "# target %s, %s\n%s", t.config.Name, d.Time.Format(time.RFC3339), d.Text)
+		}
+	}
+
+	if !found {
+		http.Error(rw, fmt.Sprintf("unknown target %q", name), http.StatusNotFound)
+		return
+	}
+	rw.Header().Set("Content-Type", "text/x-diff; charset=utf-8")
+	rw.Write([]byte(b.String()))
+}
+
+// logDiff logs the diff from the previous to the new output and keeps it for
+// the diff endpoint. Must be called with t.mu held.
+func (w *Watcher) logDiff(t *Target, previous, rendered []byte) {
+	name := t.config.OutputPath
+	if name == "" {
+		name = t.config.Name
+	}
+
+	diff := unifiedDiff(name, previous, rendered)
+	if diff == "" {
+		w.logger.Debug("Rendered output unchanged", "target", t.config.Name)
+		return
+	}
+
+	t.lastDiff.Store(&outputDiff{Time: time.Now(), Text: diff})
+	w.logger.Log(context.Background(), parseLevel(w.config.Diff.LogLevel), "Output changed",
+		"target", t.config.Name,
+		"diff", truncateDiff(diff, w.config.Diff.MaxBytes),
+	)
+}
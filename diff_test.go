@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name string
+		old  string
+		new  string
+		want string
+	}{
+		{
+			name: "equal",
+			old:  "a\nb\n",
+			new:  "a\nb\n",
+			want: "",
+		},
+		{
+			name: "from empty",
+			old:  "",
+			new:  "a\nb\n",
+			want: "--- out\tprevious\n+++ out\tnew\n@@ -0,0 +1,2 @@\n+a\n+b\n",
+		},
+		{
+			name: "change with context",
+			old:  "1\n2\n3\n4\n5\n6\n7\n8\n",
+			new:  "1\n2\n3\n4\nfive\n6\n7\n8\n",
+			want: "--- out\tprevious\n+++ out\tnew\n@@ -2,7 +2,7 @@\n 2\n 3\n 4\n-5\n+five\n 6\n 7\n 8\n",
+		},
+		{
+			name: "separate hunks",
+			old:  "a\n1\n2\n3\n4\n5\n6\n7\nb\n",
+			new:  "A\n1\n2\n3\n4\n5\n6\n7\nB\n",
+			want: "--- out\tprevious\n+++ out\tnew\n@@ -1,4 +1,4 @@\n-a\n+A\n 1\n 2\n 3\n@@ -6,4 +6,4 @@\n 5\n 6\n 7\n-b\n+B\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := unifiedDiff("out", []byte(tt.old), []byte(tt.new)); got != tt.want {
+				t.Errorf("unexpected diff:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTruncateDiff(t *testing.T) {
+	diff := "+aaaa\n+bbbb\n+cccc\n"
+	if got := truncateDiff(diff, 0); got != diff {
+		t.Errorf("expected no limit with 0, got %q", got)
+	}
+	if got := truncateDiff(diff, 13); got != "+aaaa\n+bbbb\n... truncated, 12 of 18 bytes shown\n" {
+		t.Errorf("unexpected truncated diff %q", got)
+	}
+}
+
+func TestDiffEndpoint(t *testing.T) {
+	target := newTestTarget(t, "ips", "{{ range .AllIPs }}{{ . }}\n{{ end }}")
+	w := newTestWatcher(target)
+	w.handleNodeEvent("ADD", newTestNode("node1", "1.2.3.4"))
+	processQueue(w)
+	w.handleNodeEvent("ADD", newTestNode("node2", "5.6.7.8"))
+	processQueue(w)
+
+	get := func(url string) (int, string) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		w.handleDiff(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		body, _ := io.ReadAll(rec.Body)
+		return rec.Code, string(body)
+	}
+
+	code, body := get("/diff?target=ips")
+	if code != http.StatusOK || !strings.Contains(body, " 1.2.3.4\n+5.6.7.8\n") {
+		t.Errorf("unexpected diff response %d:\n%s", code, body)
+	}
+
+	if code, _ := get("/diff?target=missing"); code != http.StatusNotFound {
+		t.Errorf("expected 404 for unknown target, got %d", code)
+	}
+}
@@ -0,0 +1,318 @@
+// Copyright 2025 Fredrik Steen <fredrik@tty.se>
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v3"
+)
+
+// templateFuncs returns the functions available in templates. List
+// arguments come last so functions can be used in pipelines, e.g.
+// {{ .AllIPs | ipv4 | join "," }}
+func templateFuncs() template.FuncMap {
+	return template.FuncMap{
+		// Strings
+		"join":       func(sep string, list []string) string { return strings.Join(list, sep) },
+		"split":      func(sep, s string) []string { return strings.Split(s, sep) },
+		"upper":      strings.ToUpper,
+		"lower":      strings.ToLower,
+		"trim":       strings.TrimSpace,
+		"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+		"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+		"replace":    func(old, new, s string) string { return strings.ReplaceAll(s, old, new) },
+		"contains":   func(substr, s string) bool { return strings.Contains(s, substr) },
+		"hasPrefix":  func(prefix, s string) bool { return strings.HasPrefix(s, prefix) },
+		"hasSuffix":  func(suffix, s string) bool { return strings.HasSuffix(s, suffix) },
+		"quote":      func(s string) string { return fmt.Sprintf("%q", s) },
+		"indent":     indent,
+		"default":    defaultValue,
+
+		// Lists
+		"list":    func(items ...string) []string { return items },
+		"first":   first,
+		"last":    last,
+		"has":     func(item string, list []string) bool { return slices.Contains(list, item) },
+		"uniq":    uniq,
+		"sort":    sortStrings,
+		"reverse": reverse,
+
+		// Math
+		"add": func(a, b int) int { return a + b },
+		"sub": func(a, b int) int { return a - b },
+		"mul": func(a, b int) int { return a * b },
+		"div": divide,
+		"mod": modulo,
+		"max": func(a, b int) int { return max(a, b) },
+		"min": func(a, b int) int { return min(a, b) },
+
+		// IP addresses and CIDR prefixes
+		"sortIPs":      sortIPs,
+		"isIPv4":       isIPv4,
+		"isIPv6":       isIPv6,
+		"ipv4":         func(list []string) []string { return filterStrings(list, isIPv4) },
+		"ipv6":         func(list []string) []string { return filterStrings(list, isIPv6) },
+		"cidrContains": cidrContains,
+		"prefix":       prefix,
+		"aggregate":    aggregatePrefixes,
+
+		// Encoding
+		"toJSON":       toJSON,
+		"toPrettyJSON": toPrettyJSON,
+		"toYAML":       toYAML,
+
+		// Environment
+		"env":      os.Getenv,
+		"readFile": readFile,
+	}
+}
+
+// indent prefixes every line of s with n spaces
+func indent(n int, s string) string {
+	pad := strings.Repeat(" ", n)
+	return pad + strings.ReplaceAll(s, "\n", "\n"+pad)
+}
+
+// defaultValue returns def if value is empty
+func defaultValue(def, value any) any {
+	switch v := value.(type) {
+	case nil:
+		return def
+	case string:
+		if v == "" {
+			return def
+		}
+	case []string:
+		if len(v) == 0 {
+			return def
+		}
+	}
+	return value
+}
+
+// first returns the first element of the list, or an empty string
+func first(list []string) string {
+	if len(list) == 0 {
+		return ""
+	}
+	return list[0]
+}
+
+// last returns the last element of the list, or an empty string
+func last(list []string) string {
+	if len(list) == 0 {
+		return ""
+	}
+	return list[len(list)-1]
+}
+
+// uniq removes duplicates, keeping the first occurrence
+func uniq(list []string) []string {
+	seen := make(map[string]bool, len(list))
+	out := make([]string, 0, len(list))
+	for _, s := range list {
+		if !seen[s] {
+			seen[s] = true
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// sortStrings returns a sorted copy of the list
+func sortStrings(list []string) []string {
+	out := slices.Clone(list)
+	slices.Sort(out)
+	return out
+}
+
+// reverse returns a reversed copy of the list
+func reverse(list []string) []string {
+	out := slices.Clone(list)
+	slices.Reverse(out)
+	return out
+}
+
+// divide returns a / b
+func divide(a, b int) (int, error) {
+	if b == 0 {
+		return 0, fmt.Errorf("div: division by zero")
+	}
+	return a / b, nil
+}
+
+// modulo returns a % b
+func modulo(a, b int) (int, error) {
+	if b == 0 {
+		return 0, fmt.Errorf("mod: division by zero")
+	}
+	return a % b, nil
+}
+
+// sortIPs returns a copy of the list in numeric IP order
+func sortIPs(list []string) []string {
+	out := slices.Clone(list)
+	slices.SortFunc(out, compareIPs)
+	return out
+}
+
+// isIPv4 reports whether s is an IPv4 address
+func isIPv4(s string) bool {
+	ip, err := netip.ParseAddr(s)
+	return err == nil && ip.Unmap().Is4()
+}
+
+// isIPv6 reports whether s is an IPv6 address
+func isIPv6(s string) bool {
+	ip, err := netip.ParseAddr(s)
+	return err == nil && !ip.Unmap().Is4()
+}
+
+// filterStrings returns the elements of the list matching keep
+func filterStrings(list []string, keep func(string) bool) []string {
+	out := make([]string, 0, len(list))
+	for _, s := range list {
+		if keep(s) {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// cidrContains reports whether the CIDR prefix contains the IP address
+func cidrContains(cidr, ip string) (bool, error) {
+	p, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return false, fmt.Errorf("cidrContains: %w", err)
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false, fmt.Errorf("cidrContains: %w", err)
+	}
+	return p.Contains(addr), nil
+}
+
+// prefix returns the CIDR prefix of the given length containing the IP address
+func prefix(bits int, ip string) (string, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return "", fmt.Errorf("prefix: %w", err)
+	}
+	p, err := addr.Prefix(bits)
+	if err != nil {
+		return "", fmt.Errorf("prefix: %w", err)
+	}
+	return p.String(), nil
+}
+
+// aggregatePrefixes collapses IP addresses and CIDR prefixes into the
+// smallest list of prefixes covering exactly the same addresses
+func aggregatePrefixes(list []string) ([]string, error) {
+	prefixes := make([]netip.Prefix, 0, len(list))
+	for _, s := range list {
+		p, err := parsePrefixOrAddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("aggregate: %w", err)
+		}
+		prefixes = append(prefixes, p)
+	}
+
+	for changed := true; changed; {
+		changed = false
+		slices.SortFunc(prefixes, func(a, b netip.Prefix) int {
+			if c := a.Addr().Compare(b.Addr()); c != 0 {
+				return c
+			}
+			return a.Bits() - b.Bits()
+		})
+
+		out := make([]netip.Prefix, 0, len(prefixes))
+		for _, p := range prefixes {
+			if n := len(out); n > 0 {
+				prev := out[n-1]
+				// Already covered by the previous prefix
+				if prev.Bits() <= p.Bits() && prev.Contains(p.Addr()) {
+					continue
+				}
+				// Sibling of the previous prefix, merge into their parent
+				if prev.Bits() == p.Bits() && p.Bits() > 0 {
+					parent, _ := prev.Addr().Prefix(prev.Bits() - 1)
+					other, _ := p.Addr().Prefix(p.Bits() - 1)
+					if parent == other {
+						out[n-1] = parent
+						changed = true
+						continue
+					}
+				}
+			}
+			out = append(out, p)
+		}
+		prefixes = out
+	}
+
+	out := make([]string, 0, len(prefixes))
+	for _, p := range prefixes {
+		out = append(out, p.String())
+	}
+	return out, nil
+}
+
+// parsePrefixOrAddr parses a CIDR prefix, or an IP address as a single address prefix
+func parsePrefixOrAddr(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return p.Masked(), nil
+	}
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// toJSON encodes v as compact JSON
+func toJSON(v any) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", fmt.Errorf("toJSON: %w", err)
+	}
+	return string(b), nil
+}
+
+// toPrettyJSON encodes v as indented JSON
+func toPrettyJSON(v any) (string, error) {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("toPrettyJSON: %w", err)
+	}
+	return string(b), nil
+}
+
+// toYAML encodes v as YAML
+func toYAML(v any) (string, error) {
+	b, err := yaml.Marshal(v)
+	if err != nil {
+		return "", fmt.Errorf("toYAML: %w", err)
+	}
+	return strings.TrimSuffix(string(b), "\n"), nil
+}
+
+// readFile returns the contents of a file
+func readFile(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("readFile: %w", err)
+	}
+	return string(b), nil
+}
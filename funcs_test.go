@@ -0,0 +1,117 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"text/template"
+)
+
+// executeTemplate renders text with the template functions against data
+func executeTemplate(t *testing.T, text string, data any) (string, error) {
+	t.Helper()
+	tmpl, err := template.New("test").Funcs(templateFuncs()).Parse(text)
+	if err != nil {
+		t.Fatalf("failed to parse template %q: %v", text, err)
+	}
+
+	var b strings.Builder
+	err = tmpl.Execute(&b, data)
+	return b.String(), err
+}
+
+func TestTemplateFuncs(t *testing.T) {
+	data := NodeData{
+		Nodes: []NodeInfo{
+			{Name: "node-a", ExternalIP: "10.0.0.10", Addresses: []string{"10.0.0.10", "2001:db8::1"}, Zone: "fr-par-1"},
+			{Name: "node-b", ExternalIP: "10.0.0.9", Addresses: []string{"10.0.0.9"}},
+		},
+		StaticIPs: []string{"10.0.0.8"},
+		AllIPs:    []string{"10.0.0.9", "10.0.0.10", "2001:db8::1", "10.0.0.8"},
+	}
+	t.Setenv("WATCHER_TEST_ENV", "from-env")
+
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"join", `{{ .AllIPs | join "," }}`, "10.0.0.9,10.0.0.10,2001:db8::1,10.0.0.8"},
+		{"split", `{{ index (split "." "a.b.c") 1 }}`, "b"},
+		{"upper", `{{ (index .Nodes 0).Name | upper }}`, "NODE-A"},
+		{"replace", `{{ replace "-" "_" (index .Nodes 0).Name }}`, "node_a"},
+		{"trimPrefix", `{{ trimPrefix "node-" (index .Nodes 1).Name }}`, "b"},
+		{"contains", `{{ contains "par" (index .Nodes 0).Zone }}`, "true"},
+		{"quote", `{{ quote "a" }}`, `"a"`},
+		{"indent", `{{ indent 2 "a\nb" }}`, "  a\n  b"},
+		{"default empty", `{{ default "none" (index .Nodes 1).Zone }}`, "none"},
+		{"default set", `{{ default "none" (index .Nodes 0).Zone }}`, "fr-par-1"},
+		{"first and last", `{{ first .AllIPs }} {{ last .AllIPs }}`, "10.0.0.9 10.0.0.8"},
+		{"has", `{{ has "10.0.0.8" .StaticIPs }}`, "true"},
+		{"uniq", `{{ list "a" "b" "a" | uniq | join "," }}`, "a,b"},
+		{"sort", `{{ list "b" "c" "a" | sort | join "," }}`, "a,b,c"},
+		{"reverse", `{{ list "a" "b" | reverse | join "," }}`, "b,a"},
+		{"math", `{{ add (len .Nodes) 1 }} {{ sub 5 2 }} {{ mul 2 3 }} {{ div 7 2 }} {{ mod 7 2 }} {{ max 1 2 }} {{ min 1 2 }}`, "3 3 6 3 1 2 1"},
+		{"sortIPs", `{{ .AllIPs | sortIPs | join "," }}`, "10.0.0.8,10.0.0.9,10.0.0.10,2001:db8::1"},
+		{"ipv4", `{{ .AllIPs | ipv4 | len }}`, "3"},
+		{"ipv6", `{{ .AllIPs | ipv6 | join "," }}`, "2001:db8::1"},
+		{"isIPv6", `{{ range (index .Nodes 0).Addresses }}{{ isIPv6 . }} {{ end }}`, "false true "},
+		{"cidrContains", `{{ cidrContains "10.0.0.0/24" (index .Nodes 0).ExternalIP }}`, "true"},
+		{"prefix", `{{ prefix 24 (index .Nodes 0).ExternalIP }}`, "10.0.0.0/24"},
+		{"aggregate", `{{ .AllIPs | ipv4 | aggregate | join "," }}`, "10.0.0.8/31,10.0.0.10/32"},
+		{"toJSON", `{{ .StaticIPs | toJSON }}`, `["10.0.0.8"]`},
+		{"toYAML", `{{ .StaticIPs | toYAML }}`, "- 10.0.0.8"},
+		{"env", `{{ env "WATCHER_TEST_ENV" }}`, "from-env"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := executeTemplate(t, tt.text, data)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+
+	t.Run("div by zero fails", func(t *testing.T) {
+		if _, err := executeTemplate(t, `{{ div 1 0 }}`, data); err == nil {
+			t.Error("expected error for division by zero")
+		}
+	})
+
+	t.Run("invalid CIDR fails", func(t *testing.T) {
+		if _, err := executeTemplate(t, `{{ cidrContains "10.0.0.0/33" "10.0.0.1" }}`, data); err == nil {
+			t.Error("expected error for invalid CIDR")
+		}
+	})
+}
+
+func TestAggregatePrefixes(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []string
+		want []string
+	}{
+		{"single address", []string{"10.0.0.1"}, []string{"10.0.0.1/32"}},
+		{"siblings merge", []string{"10.0.0.0", "10.0.0.1", "10.0.0.2", "10.0.0.3"}, []string{"10.0.0.0/30"}},
+		{"covered prefix dropped", []string{"10.0.0.0/24", "10.0.0.7", "10.0.1.0/24"}, []string{"10.0.0.0/23"}},
+		{"non-siblings kept", []string{"10.0.0.1", "10.0.0.2"}, []string{"10.0.0.1/32", "10.0.0.2/32"}},
+		{"families kept apart", []string{"2001:db8::", "2001:db8::1", "10.0.0.0"}, []string{"10.0.0.0/32", "2001:db8::/127"}},
+		{"host bits masked", []string{"192.168.1.77/24"}, []string{"192.168.1.0/24"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := aggregatePrefixes(tt.in)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright 2025 Fredrik Steen <fredrik@tty.se>
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// RemovalGuardConfig limits how many applied nodes may disappear at once.
+// A change removing more is held until the same removal is still wanted
+// after ConfirmAfter seconds, or until it is approved manually.
+type RemovalGuardConfig struct {
+	MaxRemovals       int `yaml:"maxRemovals"`       // nodes, 0 for no limit
+	MaxRemovalPercent int `yaml:"maxRemovalPercent"` // percent of applied nodes, 0 for no limit
+	Window            int `yaml:"window"`            // in seconds, count removals of earlier applies within it
+	ConfirmAfter      int `yaml:"confirmAfter"`      // in seconds, 0 holds until approved manually
+}
+
+// validate checks the removal guard limits
+func (g *RemovalGuardConfig) validate() error {
+	if g.MaxRemovals < 0 || g.Window < 0 || g.ConfirmAfter < 0 {
+		return fmt.Errorf("removalGuard values must not be negative")
+	}
+	if g.MaxRemovalPercent < 0 || g.MaxRemovalPercent > 100 {
+		return fmt.Errorf("removalGuard maxRemovalPercent must be between 0 and 100")
+	}
+	return nil
+}
+
+// removalEvent is an applied change that removed nodes
+type removalEvent struct {
+	time    time.Time
+	removed int // nodes removed
+	before  int // applied nodes before the change
+}
+
+// checkRemovals reports whether a change may be applied under the removal
+// guard of the target. A held change is rechecked after the returned delay,
+// if not zero. Must be called with t.mu held.
+func (w *Watcher) checkRemovals(t *Target, change Change) (bool, time.Duration) {
+	g := t.config.RemovalGuard
+	if g == nil || len(change.Removed) == 0 {
+		t.releaseHeld()
+		return true, 0
+	}
+
+	now := time.Now()
+	t.pruneRemovals(now)
+
+	removed := len(change.Removed)
+	base := len(t.appliedData.Nodes)
+	for _, e := range t.removals {
+		removed += e.removed
+	}
+	if len(t.removals) > 0 {
+		base = t.removals[0].before
+	}
+
+	exceeded := (g.MaxRemovals > 0 && removed > g.MaxRemovals) ||
+		(g.MaxRemovalPercent > 0 && base > 0 && removed*100 > g.MaxRemovalPercent*base)
+	if !exceeded {
+		t.releaseHeld()
+		return true, 0
+	}
+
+	key := strings.Join(change.Removed, ",")
+	if key == removalKey(&t.approvedRemoval) {
+		w.logger.Warn("Applying manually approved node removal", "target", t.config.Name, "removed", change.Removed)
+		t.releaseHeld()
+		return true, 0
+	}
+
+	if key != removalKey(&t.heldRemoval) {
+		t.heldRemoval.Store(&key)
+		t.heldSince = now
+		removalsBlockedTotal.WithLabelValues(t.config.Name).Inc()
+		removalHeld.WithLabelValues(t.config.Name).Set(1)
+		w.logger.Warn("Safety check failed: too many nodes removed, holding change",
+			"target", t.config.Name,
+			"removed", change.Removed,
+			"removedInWindow", removed,
+			"appliedNodes", base,
+			"maxRemovals", g.MaxRemovals,
+			"maxRemovalPercent", g.MaxRemovalPercent,
+		)
+	}
+
+	if g.ConfirmAfter > 0 {
+		wait := time.Until(t.heldSince.Add(time.Duration(g.ConfirmAfter) * time.Second))
+		if wait <= 0 {
+			w.logger.Warn("Applying node removal confirmed by unchanged state", "target", t.config.Name, "removed", change.Removed)
+			t.releaseHeld()
+			return true, 0
+		}
+		return false, wait
+	}
+	return false, 0
+}
+
+// releaseHeld forgets the held and approved removal. Must be called with t.mu held.
+func (t *Target) releaseHeld() {
+	if removalKey(&t.heldRemoval) != "" {
+		removalHeld.WithLabelValues(t.config.Name).Set(0)
+	}
+	t.heldRemoval.Store(nil)
+	t.heldSince = time.Time{}
+	t.approvedRemoval.Store(nil)
+}
+
+// removalKey returns the removed node names stored in p, empty if none
+func removalKey(p *atomic.Pointer[string]) string {
+	if key := p.Load(); key != nil {
+		return *key
+	}
+	return ""
+}
+
+// recordRemovals remembers an applied change for the removal guard window.
+// Must be called with t.mu held.
+func (t *Target) recordRemovals(change Change, before int) {
+	g := t.config.RemovalGuard
+	if g == nil || g.Window <= 0 || len(change.Removed) == 0 {
+		return
+	}
+	t.removals = append(t.removals, removalEvent{
+		time:    time.Now(),
+		removed: len(change.Removed),
+		before:  before,
+	})
+}
+
+// pruneRemovals drops recorded removals older than the window. Must be
+// called with t.mu held.
+func (t *Target) pruneRemovals(now time.Time) {
+	window := time.Duration(t.config.RemovalGuard.Window) * time.Second
+	i := 0
+	for i < len(t.removals) && now.Sub(t.removals[i].time) >= window {
+		i++
+	}
+	t.removals = t.removals[i:]
+}
+
+// handleApprove approves the held node removal of the target in the target
+// query parameter and queues an apply. It does not take t.mu, so it answers
+// while the target runs a slow command.
+func (w *Watcher) handleApprove(rw http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("target")
+	t := w.target(name)
+	if t == nil {
+		http.Error(rw, fmt.Sprintf("unknown target %q", name), http.StatusNotFound)
+		return
+	}
+
+	held := removalKey(&t.heldRemoval)
+	if held == "" {
+		http.Error(rw, fmt.Sprintf("target %q has no held removal", name), http.StatusConflict)
+		return
+	}
+	t.approvedRemoval.Store(&held)
+
+	w.logger.Info("Node removal approved", "target", name, "removed", held)
+	w.queue.Add(name)
+	fmt.Fprintf(rw, "approved removal of %s from target %s\n", held, name)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRemovalGuard(t *testing.T) {
+	// setup applies n nodes to a target guarded by g
+	setup := func(t *testing.T, g RemovalGuardConfig, n int) (*Watcher, *Target) {
+		t.Helper()
+		target := newTestTarget(t, "ips", "{{ len .Nodes }}")
+		target.config.RemovalGuard = &g
+		w := newTestWatcher(target)
+		for i := range n {
+			w.handleNodeEvent("ADD", newTestNode(fmt.Sprintf("node%d", i), fmt.Sprintf("10.0.0.%d", i)))
+		}
+		processQueue(w)
+		return w, target
+	}
+
+	output := func(t *testing.T, target *Target) string {
+		t.Helper()
+		got, err := os.ReadFile(target.config.OutputPath)
+		if err != nil {
+			t.Fatalf("failed to read output: %v", err)
+		}
+		return string(got)
+	}
+
+	remove := func(w *Watcher, nodes ...int) {
+		for _, i := range nodes {
+			w.handleNodeEvent("DELETE", newTestNode(fmt.Sprintf("node%d", i), fmt.Sprintf("10.0.0.%d", i)))
+		}
+		processQueue(w)
+	}
+
+	t.Run("held until approved", func(t *testing.T) {
+		w, target := setup(t, RemovalGuardConfig{MaxRemovals: 1}, 5)
+		defer w.queue.ShutDown()
+
+		remove(w, 0, 1)
+		if got := output(t, target); got != "5" {
+			t.Fatalf("expected removal of 2 nodes to be held, got output %q", got)
+		}
+
+		// The worker holds target.mu while a command runs, approving must
+		// not wait for it
+		rec := httptest.NewRecorder()
+		done := make(chan struct{})
+		target.mu.Lock()
+		go func() {
+			defer close(done)
+			w.handleApprove(rec, httptest.NewRequest(http.MethodPost, "/approve?target=ips", nil))
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("approval blocked on the target lock")
+		}
+		target.mu.Unlock()
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected approval to succeed, got %d: %s", rec.Code, rec.Body.String())
+		}
+		processQueue(w)
+
+		if got := output(t, target); got != "3" {
+			t.Errorf("expected approved removal to be applied, got output %q", got)
+		}
+
+		rec = httptest.NewRecorder()
+		w.handleApprove(rec, httptest.NewRequest(http.MethodPost, "/approve?target=ips", nil))
+		if rec.Code != http.StatusConflict {
+			t.Errorf("expected conflict without a held removal, got %d", rec.Code)
+		}
+	})
+
+	t.Run("applied once confirmed", func(t *testing.T) {
+		w, target := setup(t, RemovalGuardConfig{MaxRemovalPercent: 30, ConfirmAfter: 60}, 10)
+		defer w.queue.ShutDown()
+
+		remove(w, 0, 1, 2, 3)
+		if got := output(t, target); got != "10" {
+			t.Fatalf("expected removal of 40%% to be held, got output %q", got)
+		}
+
+		// Pretend the same removal has been wanted for the whole period
+		target.mu.Lock()
+		target.heldSince = time.Now().Add(-time.Minute)
+		target.mu.Unlock()
+		w.queue.Add("ips")
+		processQueue(w)
+
+		if got := output(t, target); got != "6" {
+			t.Errorf("expected confirmed removal to be applied, got output %q", got)
+		}
+	})
+
+	t.Run("released when nodes return", func(t *testing.T) {
+		w, target := setup(t, RemovalGuardConfig{MaxRemovals: 1}, 5)
+		defer w.queue.ShutDown()
+
+		remove(w, 0, 1)
+		for _, i := range []int{0, 1} {
+			w.handleNodeEvent("ADD", newTestNode(fmt.Sprintf("node%d", i), fmt.Sprintf("10.0.0.%d", i)))
+		}
+		processQueue(w)
+
+		if held := removalKey(&target.heldRemoval); held != "" {
+			t.Errorf("expected held removal to be released, still holding %q", held)
+		}
+	})
+
+	t.Run("held on the first apply after a restart", func(t *testing.T) {
+		target := newTestTarget(t, "ips", "{{ len .Nodes }}")
+		target.config.RemovalGuard = &RemovalGuardConfig{MaxRemovals: 1}
+		backupCount := 2
+		target.config.BackupCount = &backupCount
+
+		// The last run applied 5 nodes, 2 of them are gone after the restart
+		var kept NodeData
+		for i := range 5 {
+			kept.Nodes = append(kept.Nodes, NodeInfo{Name: fmt.Sprintf("node%d", i), ExternalIP: fmt.Sprintf("10.0.0.%d", i)})
+		}
+		if err := target.saveVersion("kept", kept, []byte("5")); err != nil {
+			t.Fatalf("failed to save version: %v", err)
+		}
+		if err := os.WriteFile(target.config.OutputPath, []byte("5"), 0o644); err != nil {
+			t.Fatalf("failed to write output: %v", err)
+		}
+
+		w := newTestWatcher(target)
+		defer w.queue.ShutDown()
+		for i := range 3 {
+			w.handleNodeEvent("ADD", newTestNode(fmt.Sprintf("node%d", i+2), fmt.Sprintf("10.0.0.%d", i+2)))
+		}
+		processQueue(w)
+
+		if got := output(t, target); got != "5" {
+			t.Errorf("expected removal of 2 nodes to be held after a restart, got output %q", got)
+		}
+		if held := removalKey(&target.heldRemoval); held != "node0,node1" {
+			t.Errorf("expected node0 and node1 removal to be held, got %q", held)
+		}
+	})
+
+	t.Run("window counts earlier removals", func(t *testing.T) {
+		w, target := setup(t, RemovalGuardConfig{MaxRemovals: 1, Window: 60}, 5)
+		defer w.queue.ShutDown()
+
+		remove(w, 0)
+		if got := output(t, target); got != "4" {
+			t.Fatalf("expected single removal to be applied, got output %q", got)
+		}
+
+		remove(w, 1)
+		if got := output(t, target); got != "4" {
+			t.Errorf("expected second removal within the window to be held, got output %q", got)
+		}
+
+		if held := removalKey(&target.heldRemoval); !strings.Contains(held, "node1") {
+			t.Errorf("expected node1 removal to be held, got %q", held)
+		}
+	})
+}
@@ -0,0 +1,131 @@
+// Copyright 2025 Fredrik Steen <fredrik@tty.se>
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"k8s.io/client-go/tools/cache"
+)
+
+// HealthConfig controls when /healthz reports the watcher as unhealthy
+type HealthConfig struct {
+	// Time in seconds watch errors must keep occurring before the watcher is
+	// unhealthy, 0 disables the check
+	WatchErrorPeriod int `yaml:"watchErrorPeriod"`
+	// Time in seconds a target may have a queued change not applied before
+	// the watcher is unhealthy, 0 disables the check
+	StaleAfter int `yaml:"staleAfter"`
+}
+
+// handleWatchError records a failed watch of the node informer, see
+// cache.WatchErrorHandlerWithContext
+func (w *Watcher) handleWatchError(ctx context.Context, r *cache.Reflector, err error) {
+	cache.DefaultWatchErrorHandler(ctx, r, err)
+
+	w.healthMu.Lock()
+	defer w.healthMu.Unlock()
+
+	now := time.Now()
+	// Errors further apart than the period start a new streak
+	period := time.Duration(w.config.Health.WatchErrorPeriod) * time.Second
+	if w.lastWatchError.IsZero() || now.Sub(w.lastWatchError) > period {
+		w.watchErrorStart = now
+	}
+	w.lastWatchError = now
+	w.lastWatchErr = err
+}
+
+// healthProblems returns why the watcher is unhealthy, nil if it is healthy
+func (w *Watcher) healthProblems(now time.Time) []string {
+	var problems []string
+
+	if period := time.Duration(w.config.Health.WatchErrorPeriod) * time.Second; period > 0 {
+		w.healthMu.Lock()
+		erroring := !w.lastWatchError.IsZero() &&
+			now.Sub(w.lastWatchError) <= period &&
+			w.lastWatchError.Sub(w.watchErrorStart) >= period
+		if erroring {
+			problems = append(problems, fmt.Sprintf("node watch failing since %s: %v",
+				w.watchErrorStart.Format(time.RFC3339), w.lastWatchErr))
+		}
+		w.healthMu.Unlock()
+	}
+
+	// Changes are held back on purpose while paused
+	if staleAfter := time.Duration(w.config.Health.StaleAfter) * time.Second; staleAfter > 0 && !w.paused.Load() {
+		for _, t := range w.targets {
+			// A held removal waits for confirmation or approval, it is
+			// reported in /status instead
+			if removalKey(&t.heldRemoval) != "" {
+				continue
+			}
+			since := t.status().PendingSince
+			if !since.IsZero() && now.Sub(since) > staleAfter {
+				problems = append(problems, fmt.Sprintf("target %s not applied since %s",
+					t.config.Name, since.Format(time.RFC3339)))
+			}
+		}
+	}
+
+	return problems
+}
+
+// markPending records that the target has a change queued. It stays pending,
+// and eventually stale, until renderTarget applies it.
+func (t *Target) markPending() {
+	reconcilePending.WithLabelValues(t.config.Name).Set(1)
+	t.updateStatus(func(s *targetStatus) {
+		if s.PendingSince.IsZero() {
+			s.PendingSince = time.Now()
+		}
+	})
+}
+
+// markApplied records that the target is up to date
+func (t *Target) markApplied() {
+	reconcilePending.WithLabelValues(t.config.Name).Set(0)
+	t.updateStatus(func(s *targetStatus) { s.PendingSince = time.Time{} })
+}
+
+// readyProblems returns why the watcher is not ready, nil if it is ready.
+// The watcher is ready once the cache has synced and every target has been
+// applied.
+func (w *Watcher) readyProblems() []string {
+	if !w.synced.Load() {
+		return []string{"node cache not synced"}
+	}
+
+	var problems []string
+	for _, t := range w.targets {
+		if t.status().AppliedHash == "" {
+			problems = append(problems, fmt.Sprintf("target %s not applied yet", t.config.Name))
+		}
+	}
+	return problems
+}
+
+// handleHealthz serves the health check, 503 with the reasons if unhealthy
+func (w *Watcher) handleHealthz(rw http.ResponseWriter, r *http.Request) {
+	writeProbe(rw, w.healthProblems(time.Now()))
+}
+
+// handleReadyz serves the readiness check, 503 with the reasons if not ready
+func (w *Watcher) handleReadyz(rw http.ResponseWriter, r *http.Request) {
+	writeProbe(rw, w.readyProblems())
+}
+
+// writeProbe writes "ok" or the problems with status 503
+func writeProbe(rw http.ResponseWriter, problems []string) {
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if len(problems) > 0 {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		rw.Write([]byte(strings.Join(problems, "\n") + "\n"))
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+	rw.Write([]byte("ok\n"))
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// probe calls a probe handler and returns the status code and body
+func probe(handler http.HandlerFunc) (int, string) {
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	return rec.Code, rec.Body.String()
+}
+
+func TestReadyz(t *testing.T) {
+	w := newTestWatcher(newTestTarget(t, "ips", "{{ len .Nodes }}"))
+
+	if code, body := probe(w.handleReadyz); code != http.StatusServiceUnavailable || !strings.Contains(body, "not synced") {
+		t.Errorf("expected not ready before cache sync, got %d %q", code, body)
+	}
+
+	w.synced.Store(true)
+	if code, body := probe(w.handleReadyz); code != http.StatusServiceUnavailable || !strings.Contains(body, "ips not applied") {
+		t.Errorf("expected not ready before first apply, got %d %q", code, body)
+	}
+
+	w.handleNodeEvent("ADD", newTestNode("node1", "1.2.3.4"))
+	processQueue(w)
+	if code, body := probe(w.handleReadyz); code != http.StatusOK || body != "ok\n" {
+		t.Errorf("expected ready after first apply, got %d %q", code, body)
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	t.Run("persistent watch errors", func(t *testing.T) {
+		w := newTestWatcher()
+		w.config.Health = HealthConfig{WatchErrorPeriod: 60}
+
+		// A single recent error is tolerated
+		w.watchErrorStart = time.Now()
+		w.lastWatchError = time.Now()
+		w.lastWatchErr = errors.New("connection refused")
+		if code, _ := probe(w.handleHealthz); code != http.StatusOK {
+			t.Errorf("expected healthy after a single watch error, got %d", code)
+		}
+
+		w.watchErrorStart = time.Now().Add(-2 * time.Minute)
+		if code, body := probe(w.handleHealthz); code != http.StatusServiceUnavailable || !strings.Contains(body, "connection refused") {
+			t.Errorf("expected unhealthy with persistent watch errors, got %d %q", code, body)
+		}
+
+		// Errors stopped, the watch recovered
+		w.lastWatchError = time.Now().Add(-90 * time.Second)
+		if code, _ := probe(w.handleHealthz); code != http.StatusOK {
+			t.Errorf("expected healthy once watch errors stopped, got %d", code)
+		}
+	})
+
+	t.Run("stale target", func(t *testing.T) {
+		target := newTestTarget(t, "ips", "{{ len .Nodes }}")
+		setCommand(t, target, "/bin/false")
+		w := newTestWatcher(target)
+		w.config.Health = HealthConfig{StaleAfter: 60}
+		defer w.queue.ShutDown()
+
+		w.handleNodeEvent("ADD", newTestNode("node1", "1.2.3.4"))
+		processQueue(w)
+		if code, _ := probe(w.handleHealthz); code != http.StatusOK {
+			t.Errorf("expected healthy right after a failed apply, got %d", code)
+		}
+
+		target.updateStatus(func(s *targetStatus) { s.PendingSince = time.Now().Add(-2 * time.Minute) })
+		if code, body := probe(w.handleHealthz); code != http.StatusServiceUnavailable || !strings.Contains(body, "ips not applied") {
+			t.Errorf("expected unhealthy with a stale target, got %d %q", code, body)
+		}
+	})
+
+	t.Run("change held by a safety check", func(t *testing.T) {
+		target := newTestTarget(t, "ips", "{{ len .Nodes }}")
+		minNodeCount := 2
+		target.config.MinNodeCount = &minNodeCount
+		w := newTestWatcher(target)
+		w.config.Health = HealthConfig{StaleAfter: 60}
+		defer w.queue.ShutDown()
+
+		// Skipped below the minimum node count, without an error
+		w.handleNodeEvent("ADD", newTestNode("node1", "1.2.3.4"))
+		processQueue(w)
+		if target.status().PendingSince.IsZero() {
+			t.Fatal("expected the skipped change to stay pending")
+		}
+
+		target.updateStatus(func(s *targetStatus) { s.PendingSince = time.Now().Add(-2 * time.Minute) })
+		if code, body := probe(w.handleHealthz); code != http.StatusServiceUnavailable || !strings.Contains(body, "ips not applied") {
+			t.Errorf("expected unhealthy with a held change, got %d %q", code, body)
+		}
+
+		w.pause("test")
+		if code, _ := probe(w.handleHealthz); code != http.StatusOK {
+			t.Errorf("expected healthy while paused, got %d", code)
+		}
+		w.resume("test")
+
+		w.handleNodeEvent("ADD", newTestNode("node2", "5.6.7.8"))
+		processQueue(w)
+		if code, body := probe(w.handleHealthz); code != http.StatusOK {
+			t.Errorf("expected healthy once applied, got %d %q", code, body)
+		}
+	})
+
+	t.Run("removal held by the removal guard", func(t *testing.T) {
+		target := newTestTarget(t, "ips", "{{ len .Nodes }}")
+		target.config.RemovalGuard = &RemovalGuardConfig{MaxRemovals: 1}
+		w := newTestWatcher(target)
+		w.config.Health = HealthConfig{StaleAfter: 60}
+		defer w.queue.ShutDown()
+
+		for _, name := range []string{"node1", "node2", "node3"} {
+			w.handleNodeEvent("ADD", newTestNode(name, "10.0.0."+name[4:]))
+		}
+		processQueue(w)
+		w.handleNodeEvent("DELETE", newTestNode("node1", "10.0.0.1"))
+		w.handleNodeEvent("DELETE", newTestNode("node2", "10.0.0.2"))
+		processQueue(w)
+
+		// Held until approved, for longer than staleAfter
+		target.updateStatus(func(s *targetStatus) { s.PendingSince = time.Now().Add(-2 * time.Minute) })
+		if code, body := probe(w.handleHealthz); code != http.StatusOK {
+			t.Errorf("expected healthy with a held removal, got %d %q", code, body)
+		}
+		if held := w.status().Targets[0].HeldRemoval; len(held) != 2 || held[0] != "node1" {
+			t.Errorf("expected the held removal in the status, got %v", held)
+		}
+	})
+}
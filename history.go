@@ -0,0 +1,326 @@
+// Copyright 2025 Fredrik Steen <fredrik@tty.se>
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// outputVersion is the metadata of a backed up output, stored as
+// <version>.json next to the rendered <version>.out in the backup directory
+type outputVersion struct {
+	Version   int       `json:"version"`
+	Target    string    `json:"target"`
+	Hash      string    `json:"hash"`
+	Timestamp time.Time `json:"timestamp"` // when the version was applied
+	Data      NodeData  `json:"data"`
+}
+
+// backupDir returns the directory the output versions of the target are
+// kept in, empty if there is nowhere to keep them
+func (t *TargetConfig) backupDir() string {
+	if t.BackupDir != "" {
+		return filepath.Join(t.BackupDir, t.Name)
+	}
+	if t.OutputPath != "" {
+		return t.OutputPath + ".history"
+	}
+	return ""
+}
+
+// saveVersion stores an applied output and its node data as a new version
+// and removes the versions beyond BackupCount. Must be called with t.mu held.
+func (t *Target) saveVersion(hash string, data NodeData, rendered []byte) error {
+	if t.config.backupCount() <= 0 {
+		return nil
+	}
+
+	dir := t.config.backupDir()
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return fmt.Errorf("create backup directory: %w", err)
+	}
+
+	versions, err := listVersions(dir)
+	if err != nil {
+		return err
+	}
+
+	v := outputVersion{
+		Version:   1,
+		Target:    t.config.Name,
+		Hash:      hash,
+		Timestamp: time.Now(),
+		Data:      data,
+	}
+	if n := len(versions); n > 0 {
+		v.Version = versions[n-1].Version + 1
+	}
+
+	meta, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode version metadata: %w", err)
+	}
+
+	// The metadata is written last, it marks the version as complete
+	base := filepath.Join(dir, versionName(v.Version))
+	if err := os.WriteFile(base+".out", rendered, t.outputMode()); err != nil {
+		return fmt.Errorf("write backup: %w", err)
+	}
+	if err := os.WriteFile(base+".json", meta, 0o640); err != nil {
+		return fmt.Errorf("write backup metadata: %w", err)
+	}
+
+	versions = append(versions, v)
+	for _, old := range versions[:max(0, len(versions)-t.config.backupCount())] {
+		base := filepath.Join(dir, versionName(old.Version))
+		os.Remove(base + ".out")
+		os.Remove(base + ".json")
+	}
+
+	return nil
+}
+
+// versionName returns the file name of a version without extension
+func versionName(version int) string {
+	return fmt.Sprintf("%06d", version)
+}
+
+// listVersions returns the versions in the backup directory, oldest first
+func listVersions(dir string) ([]outputVersion, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make([]outputVersion, 0, len(paths))
+	for _, path := range paths {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read version metadata: %w", err)
+		}
+		var v outputVersion
+		if err := json.Unmarshal(b, &v); err != nil {
+			return nil, fmt.Errorf("parse version metadata %s: %w", path, err)
+		}
+		versions = append(versions, v)
+	}
+
+	slices.SortFunc(versions, func(a, b outputVersion) int { return a.Version - b.Version })
+	return versions, nil
+}
+
+// readVersionOutput returns the rendered output of a version
+func readVersionOutput(dir string, version int) ([]byte, error) {
+	b, err := os.ReadFile(filepath.Join(dir, versionName(version)+".out"))
+	if err != nil {
+		return nil, fmt.Errorf("read backup: %w", err)
+	}
+	return b, nil
+}
+
+// latestVersion returns the latest kept version of the target, nil without
+// backups
+func (t *Target) latestVersion() (*appliedOutput, error) {
+	dir := t.config.backupDir()
+	if t.config.backupCount() <= 0 || dir == "" {
+		return nil, nil
+	}
+
+	versions, err := listVersions(dir)
+	if err != nil || len(versions) == 0 {
+		return nil, err
+	}
+	v := versions[len(versions)-1]
+	output, err := readVersionOutput(dir, v.Version)
+	if err != nil {
+		return nil, err
+	}
+	return &appliedOutput{Hash: v.Hash, Data: v.Data, Output: output}, nil
+}
+
+// subcommandTarget loads the configuration and returns the target selected
+// with -target, which may be left out with a single target
+func subcommandTarget(configFile, name string) (*Config, TargetConfig, error) {
+	cfg, err := loadConfig(configFile, "", "", "", "", "")
+	if err != nil {
+		return nil, TargetConfig{}, fmt.Errorf("load configuration: %w", err)
+	}
+
+	if name == "" {
+		if len(cfg.Targets) != 1 {
+			return nil, TargetConfig{}, errors.New("-target is required with several targets")
+		}
+		return cfg, cfg.Targets[0], nil
+	}
+
+	for _, tc := range cfg.Targets {
+		if tc.Name == name {
+			return cfg, tc, nil
+		}
+	}
+	return nil, TargetConfig{}, fmt.Errorf("unknown target %q", name)
+}
+
+// runHistory implements the history subcommand, listing the kept versions
+// of a target with the nodes that changed from the version before
+func runHistory(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("history", flag.ContinueOnError)
+	configFile := flags.String("config", "config.yaml", "Path to configuration file")
+	targetName := flags.String("target", "", "Target to list versions of")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	_, tc, err := subcommandTarget(*configFile, *targetName)
+	if err != nil {
+		return err
+	}
+	if tc.backupCount() <= 0 {
+		return fmt.Errorf("target %q: backups are disabled, set backupCount", tc.Name)
+	}
+
+	versions, err := listVersions(tc.backupDir())
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "VERSION\tAPPLIED\tHASH\tNODES\tCHANGES")
+	var prev NodeData
+	for _, v := range versions {
+		fmt.Fprintf(tw, "%d\t%s\t%.12s\t%d\t%s\n",
+			v.Version, v.Timestamp.Format(time.RFC3339), v.Hash, len(v.Data.Nodes),
+			formatChange(diffNodeData(prev, v.Data)))
+		prev = v.Data
+	}
+	return tw.Flush()
+}
+
+// formatChange formats a change as +added -removed ~changed node names
+func formatChange(c Change) string {
+	var parts []string
+	for _, name := range c.Added {
+		parts = append(parts, "+"+name)
+	}
+	for _, name := range c.Removed {
+		parts = append(parts, "-"+name)
+	}
+	for _, name := range c.Changed {
+		parts = append(parts, "~"+name)
+	}
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, " ")
+}
+
+// runRollback implements the rollback subcommand, restoring a kept version
+// of the output, the previous one by default, and running the command
+func runRollback(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("rollback", flag.ContinueOnError)
+	configFile := flags.String("config", "config.yaml", "Path to configuration file")
+	targetName := flags.String("target", "", "Target to roll back")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	cfg, tc, err := subcommandTarget(*configFile, *targetName)
+	if err != nil {
+		return err
+	}
+	if tc.backupCount() <= 0 {
+		return fmt.Errorf("target %q: backups are disabled, set backupCount", tc.Name)
+	}
+
+	dir := tc.backupDir()
+	versions, err := listVersions(dir)
+	if err != nil {
+		return err
+	}
+	if len(versions) == 0 {
+		return fmt.Errorf("target %q: no versions in %s", tc.Name, dir)
+	}
+
+	// Default to the version before the latest
+	latest := versions[len(versions)-1]
+	want := latest.Version - 1
+	if flags.NArg() > 0 {
+		if want, err = strconv.Atoi(flags.Arg(0)); err != nil {
+			return fmt.Errorf("invalid version %q", flags.Arg(0))
+		}
+	}
+	i := slices.IndexFunc(versions, func(v outputVersion) bool { return v.Version == want })
+	if i < 0 {
+		return fmt.Errorf("target %q: version %d not found", tc.Name, want)
+	}
+	v := versions[i]
+
+	rendered, err := readVersionOutput(dir, v.Version)
+	if err != nil {
+		return err
+	}
+
+	t, err := newTarget(tc)
+	if err != nil {
+		return err
+	}
+	w := &Watcher{config: cfg, logger: setupLogger(cfg.LogLevel)}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ctx := context.Background()
+	data := CommandData{
+		NodeData:   v.Data,
+		Target:     tc.Name,
+		OutputPath: tc.OutputPath,
+		Hash:       v.Hash,
+		Trigger:    triggerRollback,
+		Change:     diffNodeData(latest.Data, v.Data),
+	}
+
+	if !tc.skipOutput() {
+		tmpPath, err := t.renderTemp(func(out io.Writer) error {
+			_, err := out.Write(rendered)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if err := w.validateOutput(ctx, t, data, tmpPath); err != nil {
+			os.Remove(tmpPath)
+			return err
+		}
+		if err := t.commitOutput(tmpPath); err != nil {
+			return err
+		}
+	}
+
+	stdin, err := commandStdin(tc.CommandStdin, rendered, data)
+	if err != nil {
+		return err
+	}
+	if err := w.executeCommand(ctx, t, data, stdin); err != nil {
+		return err
+	}
+
+	// The restored output is the latest applied one, keep it as a new
+	// version so the history shows the rollback
+	if err := t.saveVersion(v.Hash, v.Data, rendered); err != nil {
+		return fmt.Errorf("rolled back but failed to back up the output: %w", err)
+	}
+
+	fmt.Fprintf(out, "Rolled back target %q to version %d from %s\n", tc.Name, v.Version, v.Timestamp.Format(time.RFC3339))
+	return nil
+}
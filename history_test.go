@@ -0,0 +1,130 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSaveVersion(t *testing.T) {
+	target := newTestTarget(t, "ips", "{{ range .AllIPs }}{{ . }}\n{{ end }}")
+	backupCount := 2
+	target.config.BackupCount = &backupCount
+
+	w := newTestWatcher(target)
+	for _, node := range []string{"node1", "node2", "node3"} {
+		w.handleNodeEvent("ADD", newTestNode(node, "10.0.0."+node[len(node)-1:]))
+		processQueue(w)
+	}
+
+	dir := target.config.backupDir()
+	versions, err := listVersions(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(versions) != 2 || versions[0].Version != 2 || versions[1].Version != 3 {
+		t.Fatalf("expected versions 2 and 3 to be kept, got %+v", versions)
+	}
+	if len(versions[1].Data.Nodes) != 3 || versions[1].Hash != target.appliedHash {
+		t.Errorf("unexpected metadata %+v", versions[1])
+	}
+
+	got, err := readVersionOutput(dir, 3)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(got) != "10.0.0.1\n10.0.0.2\n10.0.0.3\n" {
+		t.Errorf("unexpected backup %q", string(got))
+	}
+	if _, err := os.Stat(filepath.Join(dir, versionName(1)+".out")); !os.IsNotExist(err) {
+		t.Error("expected version 1 to be pruned")
+	}
+}
+
+func TestHistoryAndRollback(t *testing.T) {
+	dir := t.TempDir()
+	templatePath := filepath.Join(dir, "ips.tmpl")
+	if err := os.WriteFile(templatePath, []byte("{{ range .AllIPs }}{{ . }}\n{{ end }}"), 0o644); err != nil {
+		t.Fatalf("failed to write template: %v", err)
+	}
+	outputPath := filepath.Join(dir, "ips.out")
+	triggerFile := filepath.Join(dir, "trigger")
+	script := writeScript(t, dir, "reload.sh", `echo "$WATCHER_TRIGGER $WATCHER_REMOVED_NODES" > `+triggerFile)
+	rejectFile := filepath.Join(dir, "reject")
+	validate := writeScript(t, dir, "validate.sh", `[ ! -e `+rejectFile+` ]`)
+
+	configPath := filepath.Join(dir, "config.yaml")
+	config := "templatePath: " + templatePath + "\noutputPath: " + outputPath +
+		"\ncommand: " + script + "\nvalidateCommand: " + validate + "\nbackupCount: 5\nminNodeCount: 0\n"
+	if err := os.WriteFile(configPath, []byte(config), 0o644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+
+	cfg, err := loadConfig(configPath, "", "", "", "", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	target, err := newTarget(cfg.Targets[0])
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	w := newTestWatcher(target)
+	w.handleNodeEvent("ADD", newTestNode("node1", "10.0.0.1"))
+	processQueue(w)
+	w.handleNodeEvent("ADD", newTestNode("node2", "10.0.0.2"))
+	processQueue(w)
+
+	var history strings.Builder
+	if err := runHistory([]string{"-config", configPath}, &history); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(history.String()), "\n")
+	if len(lines) != 3 || !strings.HasSuffix(lines[1], "+node1") || !strings.HasSuffix(lines[2], "+node2") {
+		t.Errorf("unexpected history:\n%s", history.String())
+	}
+
+	var out strings.Builder
+	if err := os.WriteFile(rejectFile, nil, 0o644); err != nil {
+		t.Fatalf("failed to write reject file: %v", err)
+	}
+	if err := runRollback([]string{"-config", configPath}, &out); err == nil {
+		t.Fatal("expected the rollback to fail validation")
+	}
+	if got, _ := os.ReadFile(outputPath); string(got) != "10.0.0.1\n10.0.0.2\n" {
+		t.Errorf("expected output to be kept after failed validation, got %q", string(got))
+	}
+	os.Remove(rejectFile)
+
+	if err := runRollback([]string{"-config", configPath}, &out); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	got, err := os.ReadFile(outputPath)
+	if err != nil {
+		t.Fatalf("failed to read output: %v", err)
+	}
+	if string(got) != "10.0.0.1\n" {
+		t.Errorf("expected version 1 to be restored, got %q", string(got))
+	}
+	trigger, err := os.ReadFile(triggerFile)
+	if err != nil {
+		t.Fatalf("failed to read trigger: %v", err)
+	}
+	if string(trigger) != "rollback node2\n" {
+		t.Errorf("expected command to run for the rollback, got %q", string(trigger))
+	}
+
+	history.Reset()
+	if err := runHistory([]string{"-config", configPath}, &history); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	lines = strings.Split(strings.TrimSpace(history.String()), "\n")
+	if len(lines) != 4 || !strings.HasSuffix(lines[3], "-node2") {
+		t.Errorf("expected the rollback as a new version:\n%s", history.String())
+	}
+
+	if err := runRollback([]string{"-config", configPath, "9"}, &out); err == nil {
+		t.Error("expected error for unknown version")
+	}
+}
@@ -2,19 +2,30 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log/slog"
+	"maps"
+	"math/rand/v2"
 	"net/http"
+	"net/netip"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"reflect"
+	"slices"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"text/template"
 	"time"
@@ -23,10 +34,14 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"gopkg.in/yaml.v3"
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/util/workqueue"
 )
 
 // version is set via ldflags during build
@@ -45,17 +60,17 @@ var (
 	rendersTotal = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "k8s_node_watcher_renders_total",
-			Help: "Total number of template renders by result",
+			Help: "Total number of template renders by target and result",
 		},
-		[]string{"result"},
+		[]string{"target", "result"},
 	)
 
 	commandExecutionsTotal = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "k8s_node_watcher_command_executions_total",
-			Help: "Total number of command executions by result",
+			Help: "Total number of command executions by target and result",
 		},
-		[]string{"result"},
+		[]string{"target", "result"},
 	)
 
 	currentNodeCount = prometheus.NewGauge(
@@ -65,6 +80,84 @@ var (
 		},
 	)
 
+	reconcilePending = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "k8s_node_watcher_reconcile_pending",
+			Help: "Whether a target has changes that are not successfully applied yet (1) or not (0)",
+		},
+		[]string{"target"},
+	)
+
+	reconcileRetriesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "k8s_node_watcher_reconcile_retries_total",
+			Help: "Total number of retries of failed renders and commands by target",
+		},
+		[]string{"target"},
+	)
+
+	commandTimeoutsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "k8s_node_watcher_command_timeouts_total",
+			Help: "Total number of commands killed after exceeding their timeout by target",
+		},
+		[]string{"target"},
+	)
+
+	validationsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "k8s_node_watcher_validations_total",
+			Help: "Total number of rendered output validations by target and result",
+		},
+		[]string{"target", "result"},
+	)
+
+	healthChecksTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "k8s_node_watcher_health_checks_total",
+			Help: "Total number of post-apply health checks by target and result",
+		},
+		[]string{"target", "result"},
+	)
+
+	rollbacksTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "k8s_node_watcher_rollbacks_total",
+			Help: "Total number of rollbacks after failed health checks by target and result",
+		},
+		[]string{"target", "result"},
+	)
+
+	removalsBlockedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "k8s_node_watcher_removals_blocked_total",
+			Help: "Total number of changes held for removing too many nodes by target",
+		},
+		[]string{"target"},
+	)
+
+	removalHeld = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "k8s_node_watcher_removal_held",
+			Help: "Whether a target has a node removal held by the removal guard (1) or not (0)",
+		},
+		[]string{"target"},
+	)
+
+	applyPaused = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "k8s_node_watcher_paused",
+			Help: "Whether applying is paused (1) or not (0)",
+		},
+	)
+
+	drainingNodeCount = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "k8s_node_watcher_nodes_draining",
+			Help: "Current number of removed nodes kept until the removal delay expires",
+		},
+	)
+
 	watcherStartTime = prometheus.NewGauge(
 		prometheus.GaugeOpts{
 			Name: "k8s_node_watcher_start_time_seconds",
@@ -78,49 +171,317 @@ func init() {
 	prometheus.MustRegister(nodeEventsTotal)
 	prometheus.MustRegister(rendersTotal)
 	prometheus.MustRegister(commandExecutionsTotal)
+	prometheus.MustRegister(commandTimeoutsTotal)
 	prometheus.MustRegister(currentNodeCount)
+	prometheus.MustRegister(drainingNodeCount)
+	prometheus.MustRegister(reconcilePending)
+	prometheus.MustRegister(reconcileRetriesTotal)
+	prometheus.MustRegister(validationsTotal)
+	prometheus.MustRegister(healthChecksTotal)
+	prometheus.MustRegister(rollbacksTotal)
+	prometheus.MustRegister(removalsBlockedTotal)
+	prometheus.MustRegister(removalHeld)
+	prometheus.MustRegister(applyPaused)
 	prometheus.MustRegister(watcherStartTime)
 }
 
 // Config is the application configuration
 type Config struct {
-	LogLevel       string   `yaml:"logLevel"`
-	KubeConfig     string   `yaml:"kubeConfig"`
-	TemplatePath   string   `yaml:"templatePath"`
-	OutputPath     string   `yaml:"outputPath"`
-	Command        string   `yaml:"command"`
+	LogLevel       string `yaml:"logLevel"`
+	KubeConfig     string `yaml:"kubeConfig"`
+	ResyncInterval int    `yaml:"resyncInterval"` // in seconds
+	MetricsAddr    string `yaml:"metricsAddr"`    // address for metrics/health HTTP server
+
+	// Time in seconds to wait for an in-flight command on shutdown before
+	// killing it
+	ShutdownTimeout int `yaml:"shutdownTimeout"`
+
+	// Access to the admin endpoints on the metrics address
+	Admin AdminConfig `yaml:"admin"`
+
+	// Top level target settings. Used as the only target when Targets is
+	// empty, otherwise as defaults for every entry in Targets.
+	TargetConfig `yaml:",inline"`
+
+	Targets []TargetConfig `yaml:"targets"`
+
+	NodeSelector NodeSelectorConfig `yaml:"nodeSelector"`
+	Readiness    ReadinessConfig    `yaml:"readiness"`
+	Retry        RetryConfig        `yaml:"retry"`
+	Debounce     DebounceConfig     `yaml:"debounce"`
+	Dampening    DampeningConfig    `yaml:"dampening"`
+	Diff         DiffConfig         `yaml:"diff"`
+	Health       HealthConfig       `yaml:"health"`
+
+	// Node address types in order of preference, the first type a node
+	// has addresses for is used. Defaults to ExternalIP.
+	AddressTypes []string `yaml:"addressTypes"`
+
+	// Node metadata fields that trigger a re-render when they change, see
+	// hashFieldNames. Names and addresses always do.
+	HashFields []string `yaml:"hashFields"`
+}
+
+// DampeningConfig delays node removals and additions so flapping nodes do
+// not rewrite the output on every change
+type DampeningConfig struct {
+	RemovalDelay int  `yaml:"removalDelay"` // in seconds, a deleted node or one without addresses is kept
+	MarkDraining bool `yaml:"markDraining"` // set Draining on nodes kept for the removal delay
+	AddDelay     int  `yaml:"addDelay"`     // in seconds, before a new node is added
+}
+
+// DiffConfig controls logging of the diff between the previous and the new
+// rendered output
+type DiffConfig struct {
+	LogLevel string `yaml:"logLevel"` // debug (default), info, warn or error
+	MaxBytes int    `yaml:"maxBytes"` // larger diffs are truncated in the log, 0 for no limit
+}
+
+// NodeSelectorConfig selects which nodes are included in the template data
+type NodeSelectorConfig struct {
+	LabelSelector        string   `yaml:"labelSelector"`        // e.g. "node-role=edge"
+	FieldSelector        string   `yaml:"fieldSelector"`        // e.g. "metadata.name!=bastion"
+	ExcludeTaints        []string `yaml:"excludeTaints"`        // key[=value][:effect]
+	ExcludeUnschedulable bool     `yaml:"excludeUnschedulable"` // skip cordoned nodes
+}
+
+// TargetConfig is the configuration for a single render target
+type TargetConfig struct {
+	Name         string      `yaml:"name"`
+	TemplatePath string      `yaml:"templatePath"` // file, glob or directory
+	OutputPath   string      `yaml:"outputPath"`
+	Command      CommandLine `yaml:"command"` // path, or argv list of templates
+	// Time in seconds before the command and its children are killed, 0 for no timeout
+	CommandTimeout *int     `yaml:"commandTimeout"`
 	StaticIPs      []string `yaml:"staticIPs"`
-	ResyncInterval int      `yaml:"resyncInterval"` // in seconds
-	MinNodeCount   int      `yaml:"minNodeCount"`   // minimum nodes to prevent empty list
-	MetricsAddr    string   `yaml:"metricsAddr"`    // address for metrics/health HTTP server
+	MinNodeCount   *int     `yaml:"minNodeCount"` // minimum nodes to prevent empty list
+	IPFamily       string   `yaml:"ipFamily"`     // restrict addresses to "ipv4" or "ipv6"
+	SortBy         string   `yaml:"sortBy"`       // name, ip, creationTime or label:<key>
+
+	// Files, globs or directories with shared {{ define }} blocks
+	TemplateIncludes []string `yaml:"templateIncludes"`
+	// Template to execute, required when templatePath matches several files
+	TemplateName string `yaml:"templateName"`
+
+	OutputMode  string `yaml:"outputMode"`  // octal, e.g. "0644", keeps existing mode if unset
+	OutputOwner string `yaml:"outputOwner"` // user name or uid
+	OutputGroup string `yaml:"outputGroup"` // group name or gid
+
+	// Run against the rendered temp file before it replaces the output,
+	// a failure keeps the last good output
+	ValidateCommand CommandLine `yaml:"validateCommand"`
+	// Run after the command, a failure restores the previous output and
+	// re-runs the command
+	HealthCheckCommand CommandLine `yaml:"healthCheckCommand"`
+
+	// Number of applied output versions to keep for the rollback and
+	// history subcommands, 0 disables backups
+	BackupCount *int `yaml:"backupCount"`
+	// Directory for the versions, a subdirectory per target is used.
+	// Defaults to <outputPath>.history
+	BackupDir string `yaml:"backupDir"`
+
+	// Limits on nodes disappearing in a single apply or time window
+	RemovalGuard *RemovalGuardConfig `yaml:"removalGuard"`
+
+	// Data fed to the command on stdin, "output" or "json", none if unset
+	CommandStdin string `yaml:"commandStdin"`
+	// Don't write the output file, the command gets the data on stdin or
+	// in its arguments only
+	SkipOutput *bool `yaml:"skipOutput"`
 }
 
 // NodeData is the template data
 type NodeData struct {
-	Nodes     []NodeInfo
-	StaticIPs []string
-	AllIPs    []string
-	Timestamp time.Time
+	Nodes     []NodeInfo `json:"nodes"`
+	StaticIPs []string   `json:"staticIPs"`
+	AllIPs    []string   `json:"allIPs"`
+	AllIPv4   []string   `json:"allIPv4"`
+	AllIPv6   []string   `json:"allIPv6"`
+	Timestamp time.Time  `json:"timestamp"`
 }
 
 // NodeInfo contains information about a node
 type NodeInfo struct {
-	Name       string
-	ExternalIP string
+	Name        string   `json:"name"`
+	ExternalIP  string   `json:"externalIP"`  // first address, kept for existing templates
+	Addresses   []string `json:"addresses"`   // all addresses of the selected type
+	AddressType string   `json:"addressType"` // address type the addresses are of
+	IPv4        []string `json:"ipv4"`        // IPv4 addresses in Addresses
+	IPv6        []string `json:"ipv6"`        // IPv6 addresses in Addresses
+
+	Labels         map[string]string `json:"labels"`
+	Annotations    map[string]string `json:"annotations"`
+	Zone           string            `json:"zone"`   // topology.kubernetes.io/zone label
+	Region         string            `json:"region"` // topology.kubernetes.io/region label
+	ProviderID     string            `json:"providerID"`
+	KubeletVersion string            `json:"kubeletVersion"`
+	OS             string            `json:"os"`
+	Arch           string            `json:"arch"`
+	CreationTime   time.Time         `json:"creationTime"`
+	Conditions     map[string]string `json:"conditions"` // condition type -> status
+	Taints         []corev1.Taint    `json:"taints"`
+	Unschedulable  bool              `json:"unschedulable"`
+
+	// Removed but kept until the dampening removal delay expires, only set
+	// with markDraining
+	Draining bool `json:"draining,omitempty"`
+}
+
+// Node metadata fields that can be listed in Config.HashFields
+const (
+	hashFieldLabels         = "labels"
+	hashFieldAnnotations    = "annotations"
+	hashFieldZone           = "zone"
+	hashFieldRegion         = "region"
+	hashFieldProviderID     = "providerID"
+	hashFieldKubeletVersion = "kubeletVersion"
+	hashFieldOS             = "os"
+	hashFieldArch           = "arch"
+	hashFieldCreationTime   = "creationTime"
+	hashFieldConditions     = "conditions"
+	hashFieldTaints         = "taints"
+	hashFieldUnschedulable  = "unschedulable"
+)
+
+// hashFieldNames are the valid Config.HashFields entries
+var hashFieldNames = []string{
+	hashFieldLabels, hashFieldAnnotations, hashFieldZone, hashFieldRegion,
+	hashFieldProviderID, hashFieldKubeletVersion, hashFieldOS, hashFieldArch,
+	hashFieldCreationTime, hashFieldConditions, hashFieldTaints, hashFieldUnschedulable,
+}
+
+// ReadinessConfig controls membership based on the node Ready condition
+type ReadinessConfig struct {
+	Enabled             bool `yaml:"enabled"`
+	NotReadyGracePeriod int  `yaml:"notReadyGracePeriod"` // in seconds, before a NotReady node is removed
+	ReadySettlePeriod   int  `yaml:"readySettlePeriod"`   // in seconds, before a Ready node is added back
+}
+
+// RetryConfig controls retries of failed renders and commands
+type RetryConfig struct {
+	InitialInterval int `yaml:"initialInterval"` // in seconds, doubled after every failure
+	MaxInterval     int `yaml:"maxInterval"`     // in seconds
+}
+
+// DebounceConfig controls how bursts of node changes are coalesced
+type DebounceConfig struct {
+	QuietPeriod        int `yaml:"quietPeriod"`        // in seconds without changes before applying, 0 applies at once
+	MaxWait            int `yaml:"maxWait"`            // in seconds after the first change of a burst, 0 waits for quiet
+	MinCommandInterval int `yaml:"minCommandInterval"` // in seconds between command executions of a target
 }
 
 // Watcher manages the node watching logic
 type Watcher struct {
-	config      *Config
-	client      kubernetes.Interface
-	logger      *slog.Logger
-	mu          sync.RWMutex
-	currentHash string
-	nodeIPs     map[string]string // node name -> external IP
-	tmpl        *template.Template
+	config   *Config
+	client   kubernetes.Interface
+	logger   *slog.Logger
+	mu       sync.RWMutex
+	nodes    map[string]NodeInfo // node name -> node info
+	targets  []*Target
+	selector *nodeSelector
+	store    cache.Store            // informer store, used to re-evaluate nodes
+	rechecks map[string]*time.Timer // node name -> pending re-evaluation
+	draining map[string]*time.Timer // node name -> pending delayed removal
+	settling map[string]time.Time   // node name -> first seen, for new nodes not added yet
+
+	hashFields map[string]bool // node metadata fields included in the hash
+
+	// Target names to reconcile. Events only update the node state and add
+	// to the queue, a worker applies the targets outside of w.mu.
+	queue workqueue.TypedRateLimitingInterface[string]
+
+	burstStart    time.Time   // first change not yet queued
+	debounceTimer *time.Timer // queues the targets once changes are quiet
+
+	synced          atomic.Bool // informer cache synced
+	paused          atomic.Bool // applying paused, node state is still tracked
+	healthMu        sync.Mutex
+	watchErrorStart time.Time // first watch error of the current streak
+	lastWatchError  time.Time
+	lastWatchErr    error
+}
+
+// nodeSelector is the parsed form of NodeSelectorConfig
+type nodeSelector struct {
+	labels               labels.Selector
+	fields               fields.Selector
+	taints               []taintMatcher
+	excludeUnschedulable bool
+}
+
+// taintMatcher matches taints by key and optionally value and effect
+type taintMatcher struct {
+	key    string
+	value  *string
+	effect corev1.TaintEffect
+}
+
+// Target renders one template and runs one command from the shared node state
+type Target struct {
+	config    TargetConfig
+	tmpl      *template.Template
+	args      []*template.Template // command line templates
+	validate  []*template.Template // validate command line templates
+	health    []*template.Template // health check command line templates
+	ownership outputOwnership
+
+	mu          sync.Mutex
+	desiredHash string    // hash of the latest node data
+	appliedHash string    // hash of the last successful render and command
+	appliedData NodeData  // node data of the last successful apply or kept version
+	lastCommand time.Time // start of the last command execution
+
+	// Node data rolled back after a failed health check and the error of
+	// the rollback, see errRolledBack
+	rolledBackHash string
+	rolledBackErr  error
+
+	forceApply atomic.Bool // apply on the next reconcile even if the hash is unchanged
+
+	// Removal guard state, see checkRemovals
+	removals        []removalEvent         // applied removals within the window
+	heldRemoval     atomic.Pointer[string] // removed node names of the held change, read by handleApprove without t.mu
+	heldSince       time.Time
+	approvedRemoval atomic.Pointer[string] // held removal approved manually, set without t.mu
+
+	statusMu sync.Mutex
+	state    targetStatus // copy of the apply state, see status
+
+	lastRendered []byte                     // last written output
+	lastDiff     atomic.Pointer[outputDiff] // read by the diff endpoint without t.mu
+
+	applied atomic.Pointer[appliedOutput] // rolled back to and served to pulling hosts, see handleOutput
+}
+
+// retryRateLimiter is a workqueue rate limiter backing off failed targets
+// with Watcher.retryBackoff
+type retryRateLimiter struct {
+	mu       sync.Mutex
+	failures map[string]int
+	backoff  func(failures int) time.Duration
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		var run func([]string, io.Writer) error
+		switch os.Args[1] {
+		case "history":
+			run = runHistory
+		case "rollback":
+			run = runRollback
+		case "status":
+			run = runStatus
+		}
+		if run != nil {
+			if err := run(os.Args[2:], os.Stdout); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[1], err)
+				os.Exit(1)
+			}
+			os.Exit(0)
+		}
+	}
+
 	configFile := flag.String("config", "config.yaml", "Path to configuration file")
 	logLevel := flag.String("log-level", "", "Log level (debug, info, warn, error)")
 	kubeConfig := flag.String("kubeconfig", "", "Path to kubeconfig file")
@@ -147,11 +508,19 @@ func main() {
 	// Set start time metric
 	watcherStartTime.Set(float64(time.Now().Unix()))
 
+	// Create watcher
+	watcher, err := NewWatcher(cfg, logger)
+	if err != nil {
+		logger.Error("Failed to create watcher", "error", err)
+		os.Exit(1)
+	}
+
 	// Start HTTP local http server for metrics and health checks
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
-	httpServer := startHTTPServer(cfg.MetricsAddr, logger)
+	httpServer := startHTTPServer(cfg.MetricsAddr, logger, watcher)
+	go watcher.handleSignals(ctx)
 	defer func() {
 		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer shutdownCancel()
@@ -160,13 +529,6 @@ func main() {
 		}
 	}()
 
-	// Create watcher
-	watcher, err := NewWatcher(cfg, logger)
-	if err != nil {
-		logger.Error("Failed to create watcher", "error", err)
-		os.Exit(1)
-	}
-
 	// Run watcher
 	if err := watcher.Run(ctx); err != nil {
 		logger.Error("Watcher failed", "error", err)
@@ -178,11 +540,29 @@ func main() {
 
 // loadConfig load configuration from file and applies flag overrides
 func loadConfig(configFile, logLevel, kubeConfig, templatePath, outputPath, metricsAddr string) (*Config, error) {
+	minNodeCount := 1 // at least 1 node by default (safety net?)
 	cfg := &Config{
 		LogLevel:       "info",
 		ResyncInterval: 300,              // 5 minutes default
-		MinNodeCount:   1,                // at least 1 node by default (safety net?)
 		MetricsAddr:    "localhost:8089", // default metric listener address
+
+		ShutdownTimeout: 30,
+		Retry: RetryConfig{
+			InitialInterval: 1,
+			MaxInterval:     300,
+		},
+		Diff: DiffConfig{
+			LogLevel: "debug",
+			MaxBytes: 16384,
+		},
+		Health: HealthConfig{
+			WatchErrorPeriod: 120,
+			StaleAfter:       900,
+		},
+		TargetConfig: TargetConfig{
+			Name:         "default",
+			MinNodeCount: &minNodeCount,
+		},
 	}
 
 	// Load from file if it exists
@@ -214,58 +594,293 @@ func loadConfig(configFile, logLevel, kubeConfig, templatePath, outputPath, metr
 		cfg.MetricsAddr = metricsAddr
 	}
 
-	// Validate required fields
-	if cfg.TemplatePath == "" {
-		return nil, fmt.Errorf("templatePath is required")
+	if err := cfg.resolveTargets(); err != nil {
+		return nil, err
+	}
+
+	for _, addrType := range cfg.AddressTypes {
+		if !validAddressTypes[corev1.NodeAddressType(addrType)] {
+			return nil, fmt.Errorf("unknown address type %q", addrType)
+		}
 	}
-	if cfg.OutputPath == "" {
-		return nil, fmt.Errorf("outputPath is required")
+
+	for _, field := range cfg.HashFields {
+		if !slices.Contains(hashFieldNames, field) {
+			return nil, fmt.Errorf("unknown hash field %q, must be one of %s", field, strings.Join(hashFieldNames, ", "))
+		}
 	}
-	if cfg.Command == "" {
-		return nil, fmt.Errorf("command is required")
+
+	if cfg.Admin.TokenFile != "" {
+		token, err := os.ReadFile(cfg.Admin.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("read admin token file: %w", err)
+		}
+		cfg.Admin.Token = strings.TrimSpace(string(token))
 	}
 
 	return cfg, nil
 }
 
-// setupLogger creates a logger with the specified level
-func setupLogger(level string) *slog.Logger {
-	var logLevel slog.Level
+// IP families for TargetConfig.IPFamily
+const (
+	ipv4 = "ipv4"
+	ipv6 = "ipv6"
+)
+
+// Sort keys for TargetConfig.SortBy
+const (
+	sortByName         = "name"
+	sortByIP           = "ip"
+	sortByCreationTime = "creationTime"
+	sortByLabelPrefix  = "label:"
+)
+
+// validAddressTypes are the node address types that can be configured
+var validAddressTypes = map[corev1.NodeAddressType]bool{
+	corev1.NodeExternalIP:  true,
+	corev1.NodeInternalIP:  true,
+	corev1.NodeHostName:    true,
+	corev1.NodeExternalDNS: true,
+	corev1.NodeInternalDNS: true,
+}
+
+// addressTypes returns the configured address types, ExternalIP if unset
+func (cfg *Config) addressTypes() []corev1.NodeAddressType {
+	if len(cfg.AddressTypes) == 0 {
+		return []corev1.NodeAddressType{corev1.NodeExternalIP}
+	}
+
+	types := make([]corev1.NodeAddressType, 0, len(cfg.AddressTypes))
+	for _, addrType := range cfg.AddressTypes {
+		types = append(types, corev1.NodeAddressType(addrType))
+	}
+	return types
+}
+
+// resolveTargets fills in defaults from the top level settings and validates
+// every target. Without a targets list the top level settings are the target.
+func (cfg *Config) resolveTargets() error {
+	if len(cfg.Targets) == 0 {
+		if err := cfg.TargetConfig.validate(); err != nil {
+			return err
+		}
+		cfg.Targets = []TargetConfig{cfg.TargetConfig}
+		return nil
+	}
+
+	names := make(map[string]bool, len(cfg.Targets))
+	outputs := make(map[string]string, len(cfg.Targets))
+	for i := range cfg.Targets {
+		t := &cfg.Targets[i]
+		if t.Name == "" {
+			return fmt.Errorf("targets[%d]: name is required", i)
+		}
+		if names[t.Name] {
+			return fmt.Errorf("target %q: duplicate name", t.Name)
+		}
+		names[t.Name] = true
+
+		t.inherit(cfg.TargetConfig)
+		if err := t.validate(); err != nil {
+			return fmt.Errorf("target %q: %w", t.Name, err)
+		}
+
+		if t.OutputPath == "" {
+			continue
+		}
+		if other, ok := outputs[t.OutputPath]; ok {
+			return fmt.Errorf("target %q: outputPath %s already used by target %q", t.Name, t.OutputPath, other)
+		}
+		outputs[t.OutputPath] = t.Name
+	}
+
+	return nil
+}
+
+// inherit copies unset fields from the defaults
+func (t *TargetConfig) inherit(defaults TargetConfig) {
+	if t.TemplatePath == "" {
+		t.TemplatePath = defaults.TemplatePath
+	}
+	if t.OutputPath == "" {
+		t.OutputPath = defaults.OutputPath
+	}
+	if len(t.Command) == 0 {
+		t.Command = defaults.Command
+	}
+	if t.CommandTimeout == nil {
+		t.CommandTimeout = defaults.CommandTimeout
+	}
+	if t.StaticIPs == nil {
+		t.StaticIPs = defaults.StaticIPs
+	}
+	if t.MinNodeCount == nil {
+		t.MinNodeCount = defaults.MinNodeCount
+	}
+	if t.IPFamily == "" {
+		t.IPFamily = defaults.IPFamily
+	}
+	if t.SortBy == "" {
+		t.SortBy = defaults.SortBy
+	}
+	if t.TemplateIncludes == nil {
+		t.TemplateIncludes = defaults.TemplateIncludes
+	}
+	if t.TemplateName == "" {
+		t.TemplateName = defaults.TemplateName
+	}
+	if t.OutputMode == "" {
+		t.OutputMode = defaults.OutputMode
+	}
+	if t.OutputOwner == "" {
+		t.OutputOwner = defaults.OutputOwner
+	}
+	if t.OutputGroup == "" {
+		t.OutputGroup = defaults.OutputGroup
+	}
+	if len(t.ValidateCommand) == 0 {
+		t.ValidateCommand = defaults.ValidateCommand
+	}
+	if len(t.HealthCheckCommand) == 0 {
+		t.HealthCheckCommand = defaults.HealthCheckCommand
+	}
+	if t.RemovalGuard == nil {
+		t.RemovalGuard = defaults.RemovalGuard
+	}
+	if t.BackupCount == nil {
+		t.BackupCount = defaults.BackupCount
+	}
+	if t.BackupDir == "" {
+		t.BackupDir = defaults.BackupDir
+	}
+	if t.CommandStdin == "" {
+		t.CommandStdin = defaults.CommandStdin
+	}
+	if t.SkipOutput == nil {
+		t.SkipOutput = defaults.SkipOutput
+	}
+}
+
+// validate checks that required fields are set
+func (t *TargetConfig) validate() error {
+	if t.TemplatePath == "" {
+		return fmt.Errorf("templatePath is required")
+	}
+	if t.OutputPath == "" && !t.skipOutput() {
+		return fmt.Errorf("outputPath is required")
+	}
+	if len(t.Command) == 0 || t.Command[0] == "" {
+		return fmt.Errorf("command is required")
+	}
+	switch t.IPFamily {
+	case "", ipv4, ipv6:
+	default:
+		return fmt.Errorf("unknown ipFamily %q, must be %s or %s", t.IPFamily, ipv4, ipv6)
+	}
+	switch {
+	case t.SortBy == "", t.SortBy == sortByName, t.SortBy == sortByIP, t.SortBy == sortByCreationTime:
+	case strings.HasPrefix(t.SortBy, sortByLabelPrefix) && len(t.SortBy) > len(sortByLabelPrefix):
+	default:
+		return fmt.Errorf("unknown sortBy %q, must be %s, %s, %s or %s<key>", t.SortBy, sortByName, sortByIP, sortByCreationTime, sortByLabelPrefix)
+	}
+	if t.RemovalGuard != nil {
+		if err := t.RemovalGuard.validate(); err != nil {
+			return err
+		}
+	}
+	if t.backupCount() > 0 && t.backupDir() == "" {
+		return fmt.Errorf("backupDir is required for backups with skipOutput")
+	}
+	switch t.CommandStdin {
+	case "", stdinOutput, stdinJSON:
+	default:
+		return fmt.Errorf("unknown commandStdin %q, must be %s or %s", t.CommandStdin, stdinOutput, stdinJSON)
+	}
+	return nil
+}
+
+// minNodeCount returns the configured minimum node count, 0 if unset
+func (t *TargetConfig) minNodeCount() int {
+	if t.MinNodeCount == nil {
+		return 0
+	}
+	return *t.MinNodeCount
+}
+
+// commandTimeout returns the configured command timeout, 0 if unset
+func (t *TargetConfig) commandTimeout() time.Duration {
+	if t.CommandTimeout == nil {
+		return 0
+	}
+	return time.Duration(*t.CommandTimeout) * time.Second
+}
+
+// backupCount returns the configured number of versions to keep, 0 if unset
+func (t *TargetConfig) backupCount() int {
+	if t.BackupCount == nil {
+		return 0
+	}
+	return *t.BackupCount
+}
+
+// skipOutput reports whether writing the output file is disabled
+func (t *TargetConfig) skipOutput() bool {
+	return t.SkipOutput != nil && *t.SkipOutput
+}
 
+// parseLevel returns the log level by name, info if unknown
+func parseLevel(level string) slog.Level {
 	switch level {
 	case "debug":
-		logLevel = slog.LevelDebug
-	case "info":
-		logLevel = slog.LevelInfo
+		return slog.LevelDebug
 	case "warn":
-		logLevel = slog.LevelWarn
+		return slog.LevelWarn
 	case "error":
-		logLevel = slog.LevelError
+		return slog.LevelError
 	default:
-		logLevel = slog.LevelInfo
+		return slog.LevelInfo
 	}
+}
 
+// setupLogger creates a logger with the specified level
+func setupLogger(level string) *slog.Logger {
 	opts := &slog.HandlerOptions{
-		Level: logLevel,
+		Level: parseLevel(level),
 	}
 
 	handler := slog.NewTextHandler(os.Stdout, opts)
 	return slog.New(handler)
 }
 
-// startHTTPServer starts the HTTP server for metrics and health endpoints
-func startHTTPServer(addr string, logger *slog.Logger) *http.Server {
+// startHTTPServer starts the HTTP server for metrics, health and watcher endpoints
+func startHTTPServer(addr string, logger *slog.Logger, watcher *Watcher) *http.Server {
 	mux := http.NewServeMux()
 
-	// Simple 200 OK health check endpoint
-	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("ok\n"))
-	})
+	// Health fails on persistent watch errors and targets failing to apply,
+	// ready once the cache has synced and every target has been applied
+	mux.HandleFunc("/healthz", watcher.handleHealthz)
+	mux.HandleFunc("/readyz", watcher.handleReadyz)
 
 	// Metrics endpoint
 	mux.Handle("/metrics", promhttp.Handler())
 
+	// Watcher state as JSON
+	mux.HandleFunc("/status", watcher.handleStatus)
+
+	// Last output diff of every target
+	mux.HandleFunc("/diff", watcher.handleDiff)
+
+	// Pull mode: applied output and node data of every target
+	mux.HandleFunc("GET /targets/{target}/output", watcher.handleOutput)
+	mux.HandleFunc("GET /targets/{target}/nodes", watcher.handleNodes)
+
+	// Admin endpoints: approve a node removal held by the removal guard,
+	// pause and resume applying, force an apply
+	mux.HandleFunc("POST /approve", watcher.requireAdmin(watcher.handleApprove))
+	mux.HandleFunc("POST /pause", watcher.requireAdmin(watcher.handlePause))
+	mux.HandleFunc("POST /resume", watcher.requireAdmin(watcher.handleResume))
+	mux.HandleFunc("POST /trigger", watcher.requireAdmin(watcher.handleTrigger))
+
 	server := &http.Server{
 		Addr:    addr,
 		Handler: mux,
@@ -304,124 +919,575 @@ func NewWatcher(cfg *Config, logger *slog.Logger) (*Watcher, error) {
 		return nil, fmt.Errorf("create kubernetes client: %w", err)
 	}
 
-	tmpl, err := template.ParseFiles(cfg.TemplatePath)
+	selector, err := newNodeSelector(cfg.NodeSelector)
 	if err != nil {
-		return nil, fmt.Errorf("parse template: %w", err)
+		return nil, err
 	}
 
-	return &Watcher{
-		config:  cfg,
-		client:  clientset,
-		logger:  logger,
-		nodeIPs: make(map[string]string),
-		tmpl:    tmpl,
-	}, nil
-}
+	hashFields := make(map[string]bool, len(cfg.HashFields))
+	for _, field := range cfg.HashFields {
+		hashFields[field] = true
+	}
 
-// Run starts the watcher
-func (w *Watcher) Run(ctx context.Context) error {
-	w.logger.Info("Starting node watcher")
+	targets := make([]*Target, 0, len(cfg.Targets))
+	for _, tc := range cfg.Targets {
+		t, err := newTarget(tc)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, t)
+	}
 
-	// Create informer factory
-	factory := informers.NewSharedInformerFactory(w.client, time.Duration(w.config.ResyncInterval)*time.Second)
-	nodeInformer := factory.Core().V1().Nodes().Informer()
+	w := &Watcher{
+		config:   cfg,
+		client:   clientset,
+		logger:   logger,
+		nodes:    make(map[string]NodeInfo),
+		targets:  targets,
+		selector: selector,
+		rechecks: make(map[string]*time.Timer),
+		draining: make(map[string]*time.Timer),
+		settling: make(map[string]time.Time),
+
+		hashFields: hashFields,
+	}
+	w.queue = w.newQueue()
 
-	// Add event handlers for node events
-	// TODO:
-	// 	- Watch for NodeNotReady conditions?
-	//  - Handle taints?
-	//  - Handle node cordoning/draining?
-	_, err := nodeInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
-		AddFunc: func(obj any) {
-			node := obj.(*corev1.Node)
-			w.handleNodeEvent("ADD", node)
-		},
-		UpdateFunc: func(oldObj, newObj any) {
-			node := newObj.(*corev1.Node)
-			w.handleNodeEvent("UPDATE", node)
-		},
-		DeleteFunc: func(obj any) {
-			node := obj.(*corev1.Node)
-			w.handleNodeEvent("DELETE", node)
-		},
+	return w, nil
+}
+
+// newQueue creates the target work queue, retrying with w.retryBackoff
+func (w *Watcher) newQueue() workqueue.TypedRateLimitingInterface[string] {
+	return workqueue.NewTypedRateLimitingQueue[string](&retryRateLimiter{
+		failures: make(map[string]int),
+		backoff:  w.retryBackoff,
 	})
+}
+
+// When returns the delay before retrying the target
+func (r *retryRateLimiter) When(name string) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.failures[name]++
+	return r.backoff(r.failures[name])
+}
+
+// Forget clears the failures of the target
+func (r *retryRateLimiter) Forget(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.failures, name)
+}
+
+// NumRequeues returns the number of consecutive failures of the target
+func (r *retryRateLimiter) NumRequeues(name string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.failures[name]
+}
+
+// newNodeSelector parses the node selector configuration
+func newNodeSelector(cfg NodeSelectorConfig) (*nodeSelector, error) {
+	labelSelector, err := labels.Parse(cfg.LabelSelector)
 	if err != nil {
-		return fmt.Errorf("add event handler: %w", err)
+		return nil, fmt.Errorf("parse label selector: %w", err)
 	}
 
-	// Start informer
-	factory.Start(ctx.Done())
+	fieldSelector, err := fields.ParseSelector(cfg.FieldSelector)
+	if err != nil {
+		return nil, fmt.Errorf("parse field selector: %w", err)
+	}
 
-	// Wait for cache sync
-	w.logger.Info("Waiting for cache sync")
-	if !cache.WaitForCacheSync(ctx.Done(), nodeInformer.HasSynced) {
-		return fmt.Errorf("failed to sync cache")
+	taints := make([]taintMatcher, 0, len(cfg.ExcludeTaints))
+	for _, spec := range cfg.ExcludeTaints {
+		m, err := parseTaintMatcher(spec)
+		if err != nil {
+			return nil, err
+		}
+		taints = append(taints, m)
 	}
 
-	w.logger.Info("Cache synced, performing initial sync")
+	return &nodeSelector{
+		labels:               labelSelector,
+		fields:               fieldSelector,
+		taints:               taints,
+		excludeUnschedulable: cfg.ExcludeUnschedulable,
+	}, nil
+}
 
-	// Perform initial sync to get all current nodes
-	// This will not fail even if there are no nodes yet
-	if err := w.initialSync(nodeInformer); err != nil {
-		w.logger.Error("Initial sync failed, continuing to watch", "error", err)
-	} else {
-		w.logger.Info("Initial sync complete, watching for node changes")
+// parseTaintMatcher parses a taint in kubectl notation: key[=value][:effect]
+func parseTaintMatcher(spec string) (taintMatcher, error) {
+	var m taintMatcher
+
+	rest, effect, hasEffect := strings.Cut(spec, ":")
+	if hasEffect {
+		switch e := corev1.TaintEffect(effect); e {
+		case corev1.TaintEffectNoSchedule, corev1.TaintEffectPreferNoSchedule, corev1.TaintEffectNoExecute:
+			m.effect = e
+		default:
+			return m, fmt.Errorf("parse taint %q: unknown effect %q", spec, effect)
+		}
 	}
 
-	<-ctx.Done()
-	return nil
+	key, value, hasValue := strings.Cut(rest, "=")
+	if key == "" {
+		return m, fmt.Errorf("parse taint %q: key is required", spec)
+	}
+	m.key = key
+	if hasValue {
+		m.value = &value
+	}
+
+	return m, nil
 }
 
-// initialSync fetches all current nodes and renders the initial template
-func (w *Watcher) initialSync(informer cache.SharedIndexInformer) error {
-	w.mu.Lock()
-	defer w.mu.Unlock()
+// matches reports whether the taint matches
+func (m taintMatcher) matches(taint corev1.Taint) bool {
+	if taint.Key != m.key {
+		return false
+	}
+	if m.value != nil && taint.Value != *m.value {
+		return false
+	}
+	if m.effect != "" && taint.Effect != m.effect {
+		return false
+	}
+	return true
+}
+
+// tweakListOptions applies the label and field selectors to the API requests
+func (s *nodeSelector) tweakListOptions(opts *metav1.ListOptions) {
+	if !s.labels.Empty() {
+		opts.LabelSelector = s.labels.String()
+	}
+	if !s.fields.Empty() {
+		opts.FieldSelector = s.fields.String()
+	}
+}
+
+// matches reports whether the node should be included, and if not, why.
+// The label selector is also applied server side, checking it here as well
+// keeps the result correct for nodes whose labels changed.
+func (s *nodeSelector) matches(node *corev1.Node) (bool, string) {
+	if s == nil {
+		return true, ""
+	}
+
+	if !s.labels.Matches(labels.Set(node.Labels)) {
+		return false, "label selector"
+	}
+
+	if s.excludeUnschedulable && node.Spec.Unschedulable {
+		return false, "unschedulable"
+	}
+
+	for _, taint := range node.Spec.Taints {
+		for _, m := range s.taints {
+			if m.matches(taint) {
+				return false, "taint " + taint.ToString()
+			}
+		}
+	}
+
+	return true, ""
+}
+
+// newTarget creates a render target and parses its template
+func newTarget(cfg TargetConfig) (*Target, error) {
+	tmpl, err := parseTemplate(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("target %q: parse template: %w", cfg.Name, err)
+	}
+
+	args, err := cfg.Command.parseArgs()
+	if err != nil {
+		return nil, fmt.Errorf("target %q: %w", cfg.Name, err)
+	}
+
+	validate, err := cfg.ValidateCommand.parseArgs()
+	if err != nil {
+		return nil, fmt.Errorf("target %q: validateCommand: %w", cfg.Name, err)
+	}
+
+	health, err := cfg.HealthCheckCommand.parseArgs()
+	if err != nil {
+		return nil, fmt.Errorf("target %q: healthCheckCommand: %w", cfg.Name, err)
+	}
+
+	ownership, err := newOutputOwnership(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("target %q: %w", cfg.Name, err)
+	}
+
+	return &Target{
+		config:    cfg,
+		tmpl:      tmpl,
+		args:      args,
+		validate:  validate,
+		health:    health,
+		ownership: ownership,
+	}, nil
+}
+
+// parseTemplate parses the includes and template files of a target into one
+// template set, and returns the entry template
+func parseTemplate(cfg TargetConfig) (*template.Template, error) {
+	var includes []string
+	for _, include := range cfg.TemplateIncludes {
+		files, err := templateFiles(include)
+		if err != nil {
+			return nil, err
+		}
+		includes = append(includes, files...)
+	}
+
+	files, err := templateFiles(cfg.TemplatePath)
+	if err != nil {
+		return nil, err
+	}
+
+	name := cfg.TemplateName
+	if name == "" {
+		if len(files) > 1 {
+			return nil, fmt.Errorf("templateName is required, %s matches %d files", cfg.TemplatePath, len(files))
+		}
+		name = filepath.Base(files[0])
+	}
+
+	// Template files are parsed last, so their blocks override includes
+	tmpl, err := template.New(name).
+		Funcs(templateFuncs()).
+		ParseFiles(append(includes, files...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	// The entry may be a {{ define }} block rather than a file
+	entry := tmpl.Lookup(name)
+	if entry == nil || entry.Tree == nil {
+		return nil, fmt.Errorf("template %q not defined", name)
+	}
+
+	return entry, nil
+}
+
+// templateFiles expands a template file, glob or directory into files.
+// Directory entries are followed if they are symlinks, as in a mounted
+// ConfigMap, and hidden names like its ..data directory are skipped.
+func templateFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	switch {
+	case err == nil && info.IsDir():
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, fmt.Errorf("read template directory: %w", err)
+		}
+		var files []string
+		for _, entry := range entries {
+			if strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			file := filepath.Join(path, entry.Name())
+			if info, err := os.Stat(file); err == nil && info.Mode().IsRegular() {
+				files = append(files, file)
+			}
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("no template files in %s", path)
+		}
+		return files, nil
+	case err == nil:
+		return []string{path}, nil
+	}
+
+	files, globErr := filepath.Glob(path)
+	if globErr != nil {
+		return nil, fmt.Errorf("glob %s: %w", path, globErr)
+	}
+	if len(files) == 0 {
+		// Not a glob either, report the original error
+		return nil, err
+	}
+	return files, nil
+}
+
+// Run starts the watcher
+func (w *Watcher) Run(ctx context.Context) error {
+	w.logger.Info("Starting node watcher")
+
+	// Create informer factory
+	factory := informers.NewSharedInformerFactoryWithOptions(w.client,
+		time.Duration(w.config.ResyncInterval)*time.Second,
+		informers.WithTweakListOptions(w.selector.tweakListOptions),
+	)
+	nodeInformer := factory.Core().V1().Nodes().Informer()
+	w.store = nodeInformer.GetStore()
+	if err := nodeInformer.SetWatchErrorHandlerWithContext(w.handleWatchError); err != nil {
+		return fmt.Errorf("set watch error handler: %w", err)
+	}
+	defer w.stopRechecks()
+	defer w.stopDraining()
+	defer w.stopDebounce()
+
+	// Add event handlers for node events
+	_, err := nodeInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj any) {
+			node := obj.(*corev1.Node)
+			w.handleNodeEvent("ADD", node)
+		},
+		UpdateFunc: func(oldObj, newObj any) {
+			node := newObj.(*corev1.Node)
+			w.handleNodeEvent("UPDATE", node)
+		},
+		DeleteFunc: func(obj any) {
+			node := obj.(*corev1.Node)
+			w.handleNodeEvent("DELETE", node)
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("add event handler: %w", err)
+	}
+
+	// Start informer
+	factory.Start(ctx.Done())
+
+	// Wait for cache sync
+	w.logger.Info("Waiting for cache sync")
+	if !cache.WaitForCacheSync(ctx.Done(), nodeInformer.HasSynced) {
+		return fmt.Errorf("failed to sync cache")
+	}
+
+	w.synced.Store(true)
+	w.logger.Info("Cache synced, performing initial sync")
+
+	// Perform initial sync to get all current nodes
+	// This will not fail even if there are no nodes yet
+	if err := w.initialSync(nodeInformer); err != nil {
+		w.logger.Error("Initial sync failed, continuing to watch", "error", err)
+	} else {
+		w.logger.Info("Initial sync complete, watching for node changes")
+	}
+
+	// Apply targets in the background, so slow commands never stall the
+	// informer event delivery. The worker context is not derived from ctx,
+	// so an in-flight command gets the shutdown timeout to finish.
+	workerCtx, cancelWorker := context.WithCancel(context.Background())
+	defer cancelWorker()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w.runWorker(workerCtx)
+	}()
+
+	<-ctx.Done()
+	w.queue.ShutDown()
+
+	select {
+	case <-done:
+	case <-time.After(time.Duration(w.config.ShutdownTimeout) * time.Second):
+		w.logger.Warn("Shutdown timeout reached, killing in-flight command",
+			"timeout", time.Duration(w.config.ShutdownTimeout)*time.Second,
+		)
+		cancelWorker()
+		<-done
+	}
+
+	return nil
+}
+
+// runWorker applies queued targets until the queue is shut down
+func (w *Watcher) runWorker(ctx context.Context) {
+	for w.processNextItem(ctx) {
+	}
+}
+
+// processNextItem applies the next queued target, failed targets are
+// requeued with backoff. Returns false when the queue is shut down.
+func (w *Watcher) processNextItem(ctx context.Context) bool {
+	name, shutdown := w.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer w.queue.Done(name)
+
+	// Don't start new applies while shutting down
+	if w.queue.ShuttingDown() {
+		return false
+	}
+
+	// Keep tracking the node state, the targets are queued again on resume
+	if w.paused.Load() {
+		w.logger.Debug("Applying paused, skipping apply", "target", name)
+		return true
+	}
+
+	// Hold back until the minimum interval since the last command has passed
+	if wait := w.commandCooldown(name); wait > 0 {
+		w.logger.Debug("Delaying apply, minimum command interval", "target", name, "wait", wait)
+		w.queue.AddAfter(name, wait)
+		return true
+	}
+
+	trigger := triggerChange
+	failures := w.queue.NumRequeues(name)
+	if failures > 0 {
+		trigger = triggerRetry
+		reconcileRetriesTotal.WithLabelValues(name).Inc()
+	}
+
+	if err := w.reconcile(ctx, name, trigger); err != nil {
+		if t := w.target(name); t != nil {
+			t.markPending()
+			t.updateStatus(func(s *targetStatus) { s.LastError = err.Error() })
+		}
+		if errors.Is(err, errRolledBack) {
+			// The same node data would fail the health check again
+			w.queue.Forget(name)
+			w.logger.Warn("Node data rolled back, waiting for a node change or a forced apply",
+				"target", name,
+				"error", err,
+			)
+			return true
+		}
+		w.queue.AddRateLimited(name)
+		w.logger.Error("Failed to render and execute, retrying",
+			"target", name,
+			"failures", failures+1,
+			"error", err,
+		)
+		return true
+	}
+
+	if failures > 0 {
+		w.logger.Info("Target reconciled after failures", "target", name, "failures", failures)
+	}
+	// Only renderTarget marks the target up to date, the change may also
+	// have been held back by a safety check
+	w.queue.Forget(name)
+	if t := w.target(name); t != nil {
+		t.updateStatus(func(s *targetStatus) { s.LastError = "" })
+	}
+	return true
+}
+
+// commandCooldown returns how long until the target may run its command again
+func (w *Watcher) commandCooldown(name string) time.Duration {
+	t := w.target(name)
+	if t == nil || w.config.Debounce.MinCommandInterval <= 0 {
+		return 0
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.lastCommand.IsZero() {
+		return 0
+	}
+	interval := time.Duration(w.config.Debounce.MinCommandInterval) * time.Second
+	return time.Until(t.lastCommand.Add(interval))
+}
+
+// scheduleApply queues the targets once there have been no changes for the
+// quiet period, or the max wait since the first change of the burst has
+// passed. Must be called with w.mu held.
+func (w *Watcher) scheduleApply() {
+	cfg := w.config.Debounce
+	if cfg.QuietPeriod <= 0 {
+		w.enqueueAll()
+		return
+	}
+
+	now := time.Now()
+	if w.burstStart.IsZero() {
+		w.burstStart = now
+	}
+
+	delay := time.Duration(cfg.QuietPeriod) * time.Second
+	if cfg.MaxWait > 0 {
+		deadline := w.burstStart.Add(time.Duration(cfg.MaxWait) * time.Second)
+		delay = max(min(delay, deadline.Sub(now)), 0)
+	}
+
+	if w.debounceTimer != nil {
+		w.debounceTimer.Stop()
+	}
+	w.debounceTimer = time.AfterFunc(delay, w.flushDebounce)
+}
+
+// flushDebounce queues the targets at the end of a burst
+func (w *Watcher) flushDebounce() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.logger.Debug("Changes settled, queueing apply", "burst", time.Since(w.burstStart))
+	w.burstStart = time.Time{}
+	w.debounceTimer = nil
+	w.enqueueAll()
+}
+
+// stopDebounce stops a pending debounced apply
+func (w *Watcher) stopDebounce() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.debounceTimer != nil {
+		w.debounceTimer.Stop()
+		w.debounceTimer = nil
+	}
+}
+
+// enqueueAll queues every target to be reconciled. Targets already queued
+// are only applied once, so bursts of changes collapse into a single apply.
+func (w *Watcher) enqueueAll() {
+	for _, t := range w.targets {
+		t.markPending()
+		w.queue.Add(t.config.Name)
+	}
+}
+
+// initialSync fetches all current nodes and renders the initial template
+func (w *Watcher) initialSync(informer cache.SharedIndexInformer) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
 
 	// List all nodes from informer's store
 	items := informer.GetStore().List()
 	w.logger.Info("Initial node discovery", "count", len(items))
 
-	// Extract external IPs from all nodes
+	// Extract addresses from all nodes
 	for _, item := range items {
 		node, ok := item.(*corev1.Node)
 		if !ok {
 			w.logger.Warn("Unexpected object type in store")
 			continue
 		}
-		var externalIP string
-		for _, addr := range node.Status.Addresses {
-			if addr.Type == corev1.NodeExternalIP {
-				externalIP = addr.Address
-				break
-			}
+		// Nodes present at startup are treated as members, so a node that
+		// recently turned NotReady still gets its grace period
+		if ok, reason := w.nodeIncluded(node, true); !ok {
+			w.logger.Debug("Node excluded", "node", node.Name, "reason", reason)
+			continue
 		}
 
-		if externalIP != "" {
-			w.nodeIPs[node.Name] = externalIP
-			w.logger.Info("Discovered node", "node", node.Name, "ip", externalIP)
+		info := w.nodeInfo(node)
+		if len(info.Addresses) > 0 {
+			w.nodes[node.Name] = info
+			w.logger.Info("Discovered node", "node", node.Name, "addresses", info.Addresses, "type", info.AddressType)
 		} else {
-			w.logger.Debug("Node has no external IP", "node", node.Name)
+			w.logger.Debug("Node has no matching addresses", "node", node.Name)
 		}
 	}
 
 	// Update node count gauge
-	currentNodeCount.Set(float64(len(w.nodeIPs)))
+	currentNodeCount.Set(float64(len(w.nodes)))
 
-	// Check minimum node count (warning only, don't fail on startup)
-	if len(w.nodeIPs) < w.config.MinNodeCount {
-		w.logger.Warn("Node count below minimum, skipping initial render",
-			"current", len(w.nodeIPs),
-			"minimum", w.config.MinNodeCount,
-		)
-		return nil
-	}
-
-	// Render and execute for initial state
-	if len(w.nodeIPs) > 0 {
-		if err := w.renderAndExecute(); err != nil {
-			w.logger.Error("Initial render failed, will retry on node changes", "error", err)
-			// Don't return error - continue watching
-		}
+	// Render and execute for initial state, targets below their minimum
+	// node count are skipped (warning only, don't fail on startup)
+	if len(w.nodes) > 0 {
+		w.enqueueAll()
 	}
 
 	return nil
@@ -436,46 +1502,66 @@ func (w *Watcher) handleNodeEvent(eventType string, node *corev1.Node) {
 	nodeEventsTotal.WithLabelValues(eventType).Inc()
 
 	nodeName := node.Name
-	oldIP := w.nodeIPs[nodeName]
-
-	// Extract external IP
-	var newIP string
-	for _, addr := range node.Status.Addresses {
-		if addr.Type == corev1.NodeExternalIP {
-			newIP = addr.Address
-			break
-		}
-	}
+	old, member := w.nodes[nodeName]
+	info := w.nodeInfo(node)
+	selected, reason := w.nodeIncluded(node, member)
 
 	w.logger.Debug("Node event received",
 		"type", eventType,
 		"node", nodeName,
-		"oldIP", oldIP,
-		"newIP", newIP,
+		"oldAddresses", old.Addresses,
+		"newAddresses", info.Addresses,
+		"selected", selected,
 	)
 
 	// Update internal state
 	changed := false
-	if eventType == "DELETE" {
-		if _, exists := w.nodeIPs[nodeName]; exists {
-			delete(w.nodeIPs, nodeName)
-			changed = true
-			w.logger.Info("Node removed", "node", nodeName, "ip", oldIP)
+	switch {
+	case eventType == "DELETE":
+		w.cancelRecheck(nodeName)
+		delete(w.settling, nodeName)
+		if member {
+			changed = w.removeNode(nodeName, "Node removed")
 		}
-	} else if newIP != "" {
-		if oldIP != newIP {
-			w.nodeIPs[nodeName] = newIP
+	case !selected:
+		delete(w.settling, nodeName)
+		if member {
+			w.cancelDraining(nodeName)
+			delete(w.nodes, nodeName)
 			changed = true
-			if oldIP == "" {
-				w.logger.Info("New node added", "node", nodeName, "ip", newIP)
-			} else {
-				w.logger.Info("Node IP changed", "node", nodeName, "oldIP", oldIP, "newIP", newIP)
-			}
+			w.logger.Info("Node excluded", "node", nodeName, "addresses", old.Addresses, "reason", reason)
+		}
+	case len(info.Addresses) == 0:
+		delete(w.settling, nodeName)
+		if member {
+			changed = w.removeNode(nodeName, "Node has no matching addresses, removed")
+		}
+	case !member:
+		if settled := w.settleNode(nodeName); !settled {
+			break
 		}
+		w.nodes[nodeName] = info
+		changed = true
+		w.logger.Info("New node added", "node", nodeName, "addresses", info.Addresses, "type", info.AddressType)
+	case w.draining[nodeName] != nil:
+		w.cancelDraining(nodeName)
+		w.nodes[nodeName] = info
+		changed = true
+		w.logger.Info("Node returned, removal cancelled", "node", nodeName, "addresses", info.Addresses)
+	case !slices.Equal(old.Addresses, info.Addresses):
+		w.nodes[nodeName] = info
+		changed = true
+		w.logger.Info("Node addresses changed", "node", nodeName, "oldAddresses", old.Addresses, "newAddresses", info.Addresses)
+	case !reflect.DeepEqual(old, info):
+		// Metadata only, the hash decides if it matters for rendering
+		w.nodes[nodeName] = info
+		changed = true
+		w.logger.Debug("Node metadata changed", "node", nodeName)
 	}
 
-	// Update node count gauge
-	currentNodeCount.Set(float64(len(w.nodeIPs)))
+	// Update node count gauges
+	currentNodeCount.Set(float64(len(w.nodes)))
+	drainingNodeCount.Set(float64(len(w.draining)))
 
 	// If nothing changed, skip rendering
 	if !changed {
@@ -483,77 +1569,566 @@ func (w *Watcher) handleNodeEvent(eventType string, node *corev1.Node) {
 		return
 	}
 
+	// Render and execute in the worker, once the burst has settled
+	w.scheduleApply()
+}
+
+// nodeInfo builds the node info using the first configured address type the
+// node has addresses for. Addresses is empty if it has none of them.
+func (w *Watcher) nodeInfo(node *corev1.Node) NodeInfo {
+	info := NodeInfo{
+		Name:           node.Name,
+		Labels:         node.Labels,
+		Annotations:    node.Annotations,
+		Zone:           node.Labels[corev1.LabelTopologyZone],
+		Region:         node.Labels[corev1.LabelTopologyRegion],
+		ProviderID:     node.Spec.ProviderID,
+		KubeletVersion: node.Status.NodeInfo.KubeletVersion,
+		OS:             node.Status.NodeInfo.OperatingSystem,
+		Arch:           node.Status.NodeInfo.Architecture,
+		CreationTime:   node.CreationTimestamp.Time,
+		Taints:         node.Spec.Taints,
+		Unschedulable:  node.Spec.Unschedulable,
+	}
+
+	if len(node.Status.Conditions) > 0 {
+		info.Conditions = make(map[string]string, len(node.Status.Conditions))
+		for _, cond := range node.Status.Conditions {
+			info.Conditions[string(cond.Type)] = string(cond.Status)
+		}
+	}
+
+	for _, addrType := range w.config.addressTypes() {
+		for _, addr := range node.Status.Addresses {
+			if addr.Type == addrType {
+				info.Addresses = append(info.Addresses, addr.Address)
+			}
+		}
+		if len(info.Addresses) > 0 {
+			info.AddressType = string(addrType)
+			info.ExternalIP = info.Addresses[0]
+			break
+		}
+	}
+	info.IPv4, info.IPv6 = splitIPFamilies(info.Addresses)
+
+	return info
+}
+
+// splitIPFamilies splits addresses into IPv4 and IPv6 addresses. Anything
+// that is not an IP address, like a hostname, is left out of both.
+func splitIPFamilies(addrs []string) (v4, v6 []string) {
+	for _, a := range addrs {
+		ip, err := netip.ParseAddr(a)
+		if err != nil {
+			continue
+		}
+		if ip.Unmap().Is4() {
+			v4 = append(v4, a)
+		} else {
+			v6 = append(v6, a)
+		}
+	}
+	return v4, v6
+}
+
+// filterIPFamily restricts the node addresses to a single IP family. An
+// empty family leaves the node unchanged.
+func filterIPFamily(node NodeInfo, family string) NodeInfo {
+	switch family {
+	case ipv4:
+		node.Addresses, node.IPv6 = node.IPv4, nil
+	case ipv6:
+		node.Addresses, node.IPv4 = node.IPv6, nil
+	default:
+		return node
+	}
+
+	node.ExternalIP = ""
+	if len(node.Addresses) > 0 {
+		node.ExternalIP = node.Addresses[0]
+	}
+	return node
+}
+
+// nodeIncluded reports whether the node should be included, and if not, why.
+// member tells if the node is currently included. It schedules a recheck of
+// the node when a readiness timer is running. Must be called with w.mu held.
+func (w *Watcher) nodeIncluded(node *corev1.Node, member bool) (bool, string) {
+	if ok, reason := w.selector.matches(node); !ok {
+		w.cancelRecheck(node.Name)
+		return false, reason
+	}
+
+	ready, recheckAt := w.readyState(node, member, time.Now())
+	if recheckAt.IsZero() {
+		w.cancelRecheck(node.Name)
+	} else {
+		w.scheduleRecheck(node.Name, recheckAt)
+	}
+	if !ready {
+		return false, "not ready"
+	}
+
+	return true, ""
+}
+
+// readyState reports whether the node should be included based on its Ready
+// condition, and when it should be evaluated again (zero if not needed).
+// Timers run from the condition transition time, so resyncs do not reset them.
+func (w *Watcher) readyState(node *corev1.Node, member bool, now time.Time) (bool, time.Time) {
+	cfg := w.config.Readiness
+	if !cfg.Enabled {
+		return true, time.Time{}
+	}
+
+	// Nodes without a Ready condition have not reported in yet
+	status, since := corev1.ConditionUnknown, node.CreationTimestamp.Time
+	for _, cond := range node.Status.Conditions {
+		if cond.Type == corev1.NodeReady {
+			status, since = cond.Status, cond.LastTransitionTime.Time
+			break
+		}
+	}
+
+	if status == corev1.ConditionTrue {
+		if member {
+			return true, time.Time{}
+		}
+		settled := since.Add(time.Duration(cfg.ReadySettlePeriod) * time.Second)
+		if now.Before(settled) {
+			return false, settled
+		}
+		return true, time.Time{}
+	}
+
+	if !member {
+		return false, time.Time{}
+	}
+	expires := since.Add(time.Duration(cfg.NotReadyGracePeriod) * time.Second)
+	if now.Before(expires) {
+		return true, expires
+	}
+	return false, time.Time{}
+}
+
+// scheduleRecheck re-evaluates the node at the given time. Must be called with w.mu held.
+func (w *Watcher) scheduleRecheck(name string, at time.Time) {
+	if timer, ok := w.rechecks[name]; ok {
+		timer.Stop()
+	}
+	w.rechecks[name] = time.AfterFunc(time.Until(at), func() {
+		w.recheckNode(name)
+	})
+}
+
+// cancelRecheck stops a pending re-evaluation. Must be called with w.mu held.
+func (w *Watcher) cancelRecheck(name string) {
+	if timer, ok := w.rechecks[name]; ok {
+		timer.Stop()
+		delete(w.rechecks, name)
+	}
+}
+
+// removeNode removes a member node, or with a removal delay keeps it until
+// the delay expires. Reports whether the node state changed. Must be called
+// with w.mu held.
+func (w *Watcher) removeNode(name, msg string) bool {
+	old := w.nodes[name]
+	delay := time.Duration(w.config.Dampening.RemovalDelay) * time.Second
+	if delay <= 0 {
+		delete(w.nodes, name)
+		w.logger.Info(msg, "node", name, "addresses", old.Addresses)
+		return true
+	}
+
+	if _, ok := w.draining[name]; ok {
+		return false
+	}
+	w.draining[name] = time.AfterFunc(delay, func() {
+		w.expireDraining(name)
+	})
+	w.logger.Info("Delaying node removal", "node", name, "addresses", old.Addresses, "reason", msg, "delay", delay)
+
+	if !w.config.Dampening.MarkDraining {
+		return false
+	}
+	old.Draining = true
+	w.nodes[name] = old
+	return true
+}
+
+// cancelDraining stops a pending delayed removal. Must be called with w.mu held.
+func (w *Watcher) cancelDraining(name string) {
+	if timer, ok := w.draining[name]; ok {
+		timer.Stop()
+		delete(w.draining, name)
+	}
+}
+
+// expireDraining removes a node once its removal delay has expired
+func (w *Watcher) expireDraining(name string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// Cancelled while the timer fired
+	if _, ok := w.draining[name]; !ok {
+		return
+	}
+	delete(w.draining, name)
+	delete(w.nodes, name)
+	w.logger.Info("Node removal delay expired, removed", "node", name)
+
+	currentNodeCount.Set(float64(len(w.nodes)))
+	drainingNodeCount.Set(float64(len(w.draining)))
+	w.scheduleApply()
+}
+
+// stopDraining stops all pending delayed removals
+func (w *Watcher) stopDraining() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for name := range w.draining {
+		w.cancelDraining(name)
+	}
+}
+
+// settleNode reports whether a new node has been seen for the add delay,
+// otherwise it is re-evaluated once the delay has passed. Must be called
+// with w.mu held.
+func (w *Watcher) settleNode(name string) bool {
+	delay := time.Duration(w.config.Dampening.AddDelay) * time.Second
+	if delay <= 0 {
+		return true
+	}
+
+	now := time.Now()
+	firstSeen, ok := w.settling[name]
+	if !ok {
+		firstSeen = now
+		w.settling[name] = now
+	}
+	if settled := firstSeen.Add(delay); now.Before(settled) {
+		w.logger.Debug("New node settling", "node", name, "until", settled)
+		w.scheduleRecheck(name, settled)
+		return false
+	}
+
+	delete(w.settling, name)
+	return true
+}
+
+// stopRechecks stops all pending re-evaluations
+func (w *Watcher) stopRechecks() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for name := range w.rechecks {
+		w.cancelRecheck(name)
+	}
+}
+
+// recheckNode re-evaluates a node from the informer store
+func (w *Watcher) recheckNode(name string) {
+	obj, exists, err := w.store.GetByKey(name)
+	if err != nil || !exists {
+		w.logger.Debug("Node not found for recheck", "node", name, "error", err)
+		return
+	}
+
+	node, ok := obj.(*corev1.Node)
+	if !ok {
+		w.logger.Warn("Unexpected object type in store")
+		return
+	}
+
+	w.handleNodeEvent("RECHECK", node)
+}
+
+// reconcile applies the current node data to the named target. The node
+// state is only locked while building the data, not while rendering and
+// running the command.
+func (w *Watcher) reconcile(ctx context.Context, name, trigger string) error {
+	t := w.target(name)
+	if t == nil {
+		return nil
+	}
+
+	w.mu.RLock()
+	data := w.nodeData(t)
+	w.mu.RUnlock()
+
 	// Safety check: prevent removing all nodes
-	if len(w.nodeIPs) < w.config.MinNodeCount {
+	if len(data.Nodes) < t.config.minNodeCount() {
 		w.logger.Error("Safety check failed: node count below minimum",
-			"current", len(w.nodeIPs),
-			"minimum", w.config.MinNodeCount,
+			"target", t.config.Name,
+			"current", len(data.Nodes),
+			"minimum", t.config.minNodeCount(),
 		)
-		return
+		return nil
 	}
 
-	// Render and execute
-	if err := w.renderAndExecute(); err != nil {
-		w.logger.Error("Failed to render and execute", "error", err)
+	forced := t.forceApply.Swap(false)
+	if forced {
+		trigger = triggerManual
+	}
+	err := w.renderTarget(ctx, t, data, trigger)
+	if err != nil && forced {
+		// Keep forcing until the retry succeeds
+		t.forceApply.Store(true)
 	}
+	return err
 }
 
-// renderAndExecute renders the template and executes the command
-func (w *Watcher) renderAndExecute() error {
-	// Build node data
-	nodes := make([]NodeInfo, 0, len(w.nodeIPs))
-	allIPs := make([]string, 0, len(w.nodeIPs)+len(w.config.StaticIPs))
+// target returns the target with the given name, nil if there is none
+func (w *Watcher) target(name string) *Target {
+	for _, t := range w.targets {
+		if t.config.Name == name {
+			return t
+		}
+	}
+	return nil
+}
 
-	for name, ip := range w.nodeIPs {
-		nodes = append(nodes, NodeInfo{
-			Name:       name,
-			ExternalIP: ip,
-		})
-		allIPs = append(allIPs, ip)
+// retryBackoff returns the delay before the given retry, doubling from the
+// initial interval up to the max interval, with up to 20% jitter either way
+func (w *Watcher) retryBackoff(failures int) time.Duration {
+	initial := time.Duration(max(w.config.Retry.InitialInterval, 1)) * time.Second
+	maxDelay := time.Duration(max(w.config.Retry.MaxInterval, 1)) * time.Second
+
+	delay := initial
+	for i := 1; i < failures && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	delay = min(delay, maxDelay)
+
+	jitter := time.Duration((rand.Float64()*0.4 - 0.2) * float64(delay))
+	return delay + jitter
+}
+
+// nodeData builds the template data of a target from the current node state
+func (w *Watcher) nodeData(t *Target) NodeData {
+	nodes := make([]NodeInfo, 0, len(w.nodes))
+	allIPs := make([]string, 0, len(w.nodes)+len(t.config.StaticIPs))
+
+	for _, node := range w.nodes {
+		node = filterIPFamily(node, t.config.IPFamily)
+		if len(node.Addresses) == 0 {
+			continue
+		}
+		nodes = append(nodes, node)
+		allIPs = append(allIPs, node.Addresses...)
 	}
 
 	// Add our static IPs
-	allIPs = append(allIPs, w.config.StaticIPs...)
+	staticIPs := t.config.StaticIPs
+	if t.config.IPFamily != "" {
+		v4, v6 := splitIPFamilies(staticIPs)
+		staticIPs = v4
+		if t.config.IPFamily == ipv6 {
+			staticIPs = v6
+		}
+	}
+	allIPs = append(allIPs, staticIPs...)
+
+	sortNodes(nodes, t.config.SortBy)
+	slices.SortFunc(allIPs, compareIPs)
+	allIPs = slices.Compact(allIPs)
+	allIPv4, allIPv6 := splitIPFamilies(allIPs)
 
-	data := NodeData{
+	return NodeData{
 		Nodes:     nodes,
-		StaticIPs: w.config.StaticIPs,
+		StaticIPs: staticIPs,
 		AllIPs:    allIPs,
+		AllIPv4:   allIPv4,
+		AllIPv6:   allIPv6,
 		Timestamp: time.Now(),
 	}
+}
 
+// sortNodes sorts nodes by the given key, ties and the default are by name
+func sortNodes(nodes []NodeInfo, sortBy string) {
+	var key func(a, b NodeInfo) int
+	switch {
+	case sortBy == sortByIP:
+		key = func(a, b NodeInfo) int {
+			return compareIPs(a.ExternalIP, b.ExternalIP)
+		}
+	case sortBy == sortByCreationTime:
+		key = func(a, b NodeInfo) int {
+			return a.CreationTime.Compare(b.CreationTime)
+		}
+	case strings.HasPrefix(sortBy, sortByLabelPrefix):
+		label := strings.TrimPrefix(sortBy, sortByLabelPrefix)
+		key = func(a, b NodeInfo) int {
+			return strings.Compare(a.Labels[label], b.Labels[label])
+		}
+	default:
+		key = func(a, b NodeInfo) int { return 0 }
+	}
+
+	slices.SortStableFunc(nodes, func(a, b NodeInfo) int {
+		if c := key(a, b); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Name, b.Name)
+	})
+}
+
+// compareIPs orders IP addresses numerically, IPv4 before IPv6. Anything
+// that is not an IP address, like a hostname, sorts after them as a string.
+func compareIPs(a, b string) int {
+	ipA, errA := netip.ParseAddr(a)
+	ipB, errB := netip.ParseAddr(b)
+
+	switch {
+	case errA == nil && errB == nil:
+		return ipA.Compare(ipB)
+	case errA == nil:
+		return -1
+	case errB == nil:
+		return 1
+	default:
+		return strings.Compare(a, b)
+	}
+}
+
+// renderTarget renders the template of a single target and executes its command
+func (w *Watcher) renderTarget(ctx context.Context, t *Target, data NodeData, trigger string) error {
 	// Calculate hash to compare with previous render
 	dataHash := w.calculateHash(data)
-	if dataHash == w.currentHash {
-		w.logger.Debug("Data hash unchanged, skipping render")
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.desiredHash = dataHash
+	t.updateStatus(func(s *targetStatus) { s.DesiredHash = dataHash })
+	if dataHash == t.appliedHash && trigger != triggerManual {
+		w.logger.Debug("Data hash unchanged, skipping render", "target", t.config.Name)
+		t.releaseHeld()
+		t.rolledBackHash, t.rolledBackErr = "", nil
+		t.markApplied()
 		return nil
 	}
+	if dataHash == t.rolledBackHash && trigger != triggerManual {
+		w.logger.Debug("Node data was rolled back, skipping render", "target", t.config.Name)
+		return t.rolledBackErr
+	}
 
-	// Render template to file
-	w.logger.Info("Rendering template", "output", w.config.OutputPath, "nodeCount", len(nodes))
+	// Before the first apply compare with the latest kept version, so the
+	// change set and the removal guard also cover a restart
+	if t.appliedHash == "" && t.appliedData.Nodes == nil {
+		latest, err := t.latestVersion()
+		if err != nil {
+			w.logger.Warn("Failed to read latest backup", "target", t.config.Name, "error", err)
+		}
+		if latest != nil {
+			t.appliedData = latest.Data
+		}
+	}
 
-	outputFile, err := os.Create(w.config.OutputPath)
-	if err != nil {
-		rendersTotal.WithLabelValues("failure").Inc()
-		return fmt.Errorf("create output file: %w", err)
+	change := diffNodeData(t.appliedData, data)
+	if ok, recheck := w.checkRemovals(t, change); !ok {
+		if recheck > 0 {
+			w.queue.AddAfter(t.config.Name, recheck)
+		}
+		return nil
+	}
+
+	w.logger.Info("Rendering template", "target", t.config.Name, "output", t.config.OutputPath, "nodeCount", len(data.Nodes))
+
+	if t.appliedHash == "" && trigger == triggerChange {
+		trigger = triggerInitial
 	}
-	defer outputFile.Close()
 
-	if err := w.tmpl.Execute(outputFile, data); err != nil {
-		rendersTotal.WithLabelValues("failure").Inc()
+	cmdData := CommandData{
+		NodeData:   data,
+		Target:     t.config.Name,
+		OutputPath: t.config.OutputPath,
+		Hash:       dataHash,
+		Trigger:    trigger,
+		Change:     change,
+	}
+
+	var rendered bytes.Buffer
+	if err := t.tmpl.Execute(&rendered, data); err != nil {
+		t.observeRender("failure")
 		return fmt.Errorf("execute template: %w", err)
 	}
 
-	if err := outputFile.Sync(); err != nil {
-		rendersTotal.WithLabelValues("failure").Inc()
-		return fmt.Errorf("sync output file: %w", err)
+	// Keep the previous output to roll back to if the health check fails
+	previous, canRollback := w.previousOutput(t)
+
+	lastRendered := t.lastRendered
+	if lastRendered == nil && canRollback {
+		lastRendered = previous.Output
 	}
 
-	w.currentHash = dataHash
-	rendersTotal.WithLabelValues("success").Inc()
+	if !t.config.skipOutput() {
+		// Write to a temporary file first, a failed write must never
+		// replace the last good output
+		tmpPath, err := t.renderTemp(func(out io.Writer) error {
+			_, err := out.Write(rendered.Bytes())
+			return err
+		})
+		if err != nil {
+			t.observeRender("failure")
+			return err
+		}
+
+		if err := w.validateOutput(ctx, t, cmdData, tmpPath); err != nil {
+			os.Remove(tmpPath)
+			return err
+		}
 
-	// Execute command
-	return w.executeCommand()
+		if err := t.commitOutput(tmpPath); err != nil {
+			t.observeRender("failure")
+			return err
+		}
+	}
+
+	t.observeRender("success")
+	w.logDiff(t, lastRendered, rendered.Bytes())
+	t.lastRendered = rendered.Bytes()
+
+	// Execute command, only a successful command and health check mark the
+	// data as applied
+	stdin, err := commandStdin(t.config.CommandStdin, rendered.Bytes(), cmdData)
+	if err != nil {
+		return err
+	}
+	if err := w.executeCommand(ctx, t, cmdData, stdin); err != nil {
+		return err
+	}
+
+	if err := w.healthCheck(ctx, t, cmdData); err != nil {
+		if !canRollback {
+			return fmt.Errorf("%w, no previous output to roll back to", err)
+		}
+		if rbErr := w.rollback(ctx, t, cmdData, previous); rbErr != nil {
+			return fmt.Errorf("%w, rollback failed: %v", err, rbErr)
+		}
+		t.rolledBackHash = dataHash
+		t.rolledBackErr = fmt.Errorf("%w, %w", err, errRolledBack)
+		return t.rolledBackErr
+	}
+
+	t.recordRemovals(change, len(t.appliedData.Nodes))
+	t.appliedHash = dataHash
+	t.appliedData = data
+	t.rolledBackHash, t.rolledBackErr = "", nil
+	t.applied.Store(&appliedOutput{Hash: dataHash, Data: data, Output: rendered.Bytes()})
+	t.updateStatus(func(s *targetStatus) {
+		s.AppliedHash = dataHash
+		s.LastApplied = time.Now()
+	})
+	t.markApplied()
+
+	if err := t.saveVersion(dataHash, data, rendered.Bytes()); err != nil {
+		w.logger.Warn("Failed to back up output", "target", t.config.Name, "error", err)
+	}
+	return nil
 }
 
 func (w *Watcher) calculateHash(data NodeData) string {
@@ -569,6 +2144,13 @@ func (w *Watcher) calculateHash(data NodeData) string {
 	for _, node := range nodes {
 		h.Write([]byte(node.Name))
 		h.Write([]byte(node.ExternalIP))
+		for _, addr := range node.Addresses {
+			h.Write([]byte(addr))
+		}
+		if node.Draining {
+			h.Write([]byte("\x00draining"))
+		}
+		w.hashNodeFields(h, node)
 	}
 
 	// Sort IPs for consistent hashing
@@ -583,23 +2165,117 @@ func (w *Watcher) calculateHash(data NodeData) string {
 	return hex.EncodeToString(h.Sum(nil))
 }
 
-// executeCommand runs the configured command with the output file as argument
-func (w *Watcher) executeCommand() error {
+// hashNodeFields writes the node metadata fields listed in HashFields to the hash
+func (w *Watcher) hashNodeFields(h io.Writer, node NodeInfo) {
+	writeField := func(field, value string) {
+		fmt.Fprintf(h, "\x00%s=%s", field, value)
+	}
+	writeMap := func(field string, m map[string]string) {
+		for _, k := range slices.Sorted(maps.Keys(m)) {
+			writeField(field, k+"="+m[k])
+		}
+	}
+
+	for _, field := range hashFieldNames {
+		if !w.hashFields[field] {
+			continue
+		}
+
+		switch field {
+		case hashFieldLabels:
+			writeMap(field, node.Labels)
+		case hashFieldAnnotations:
+			writeMap(field, node.Annotations)
+		case hashFieldZone:
+			writeField(field, node.Zone)
+		case hashFieldRegion:
+			writeField(field, node.Region)
+		case hashFieldProviderID:
+			writeField(field, node.ProviderID)
+		case hashFieldKubeletVersion:
+			writeField(field, node.KubeletVersion)
+		case hashFieldOS:
+			writeField(field, node.OS)
+		case hashFieldArch:
+			writeField(field, node.Arch)
+		case hashFieldCreationTime:
+			writeField(field, node.CreationTime.UTC().Format(time.RFC3339))
+		case hashFieldConditions:
+			writeMap(field, node.Conditions)
+		case hashFieldTaints:
+			for _, taint := range node.Taints {
+				writeField(field, taint.ToString())
+			}
+		case hashFieldUnschedulable:
+			writeField(field, strconv.FormatBool(node.Unschedulable))
+		}
+	}
+}
+
+// executeCommand runs the target command with data. Must be called with t.mu held.
+func (w *Watcher) executeCommand(ctx context.Context, t *Target, data CommandData, stdin []byte) error {
 	w.logger.Info("Executing command",
-		"command", w.config.Command,
-		"arg", w.config.OutputPath,
+		"target", t.config.Name,
+		"command", t.config.Command,
+		"trigger", data.Trigger,
+		"added", data.Change.Added,
+		"removed", data.Change.Removed,
+		"changed", data.Change.Changed,
 	)
 
-	cmd := exec.Command(w.config.Command, w.config.OutputPath)
+	t.lastCommand = time.Now()
+	if err := w.runCommand(ctx, t, t.args, data, stdin); err != nil {
+		t.observeCommand("failure")
+		return err
+	}
+
+	t.observeCommand("success")
+	w.logger.Info("Command executed successfully", "target", t.config.Name)
+	return nil
+}
+
+// runCommand runs the command line templates rendered with data, with the
+// change described in WATCHER_* environment variables and stdin, if not nil,
+// as its standard input. The command runs in its own process group, which is
+// killed as a whole when the target command timeout expires or ctx is
+// cancelled.
+func (w *Watcher) runCommand(ctx context.Context, t *Target, args []*template.Template, data CommandData, stdin []byte) error {
+	argv, err := renderArgs(args, data)
+	if err != nil {
+		return err
+	}
+	w.logger.Debug("Running command", "target", t.config.Name, "argv", argv)
+
+	if timeout := t.config.commandTimeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.Env = append(os.Environ(), commandEnv(data)...)
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	// Don't wait forever for children holding stdout/stderr open
+	cmd.WaitDelay = 5 * time.Second
 
 	if err := cmd.Run(); err != nil {
-		commandExecutionsTotal.WithLabelValues("failure").Inc()
-		return fmt.Errorf("execute command: %w", err)
+		switch {
+		case errors.Is(ctx.Err(), context.DeadlineExceeded):
+			commandTimeoutsTotal.WithLabelValues(t.config.Name).Inc()
+			return fmt.Errorf("command timed out after %s: %w", t.config.commandTimeout(), err)
+		case ctx.Err() != nil:
+			return fmt.Errorf("command killed on shutdown: %w", err)
+		}
+		return fmt.Errorf("execute command %s: %w", argv[0], err)
 	}
 
-	commandExecutionsTotal.WithLabelValues("success").Inc()
-	w.logger.Info("Command executed successfully")
 	return nil
 }
@@ -1,13 +1,22 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
 	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
 )
 
 func TestCalculateHash(t *testing.T) {
@@ -169,7 +178,9 @@ func TestHTTPEndpoints(t *testing.T) {
 	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
 	addr := "localhost:18080"
 
-	server := startHTTPServer(addr, logger)
+	watcher := newTestWatcher()
+	watcher.config.Admin.Token = "secret"
+	server := startHTTPServer(addr, logger, watcher)
 	defer server.Close()
 
 	// Allow some time for the server to start
@@ -239,4 +250,1154 @@ func TestHTTPEndpoints(t *testing.T) {
 			t.Error("expected standard go metrics (go_goroutines) in response")
 		}
 	})
+
+	t.Run("approve endpoint requires the admin token", func(t *testing.T) {
+		resp, err := http.Post("http://"+addr+"/approve?target=default", "", nil)
+		if err != nil {
+			t.Fatalf("error calling /approve: %v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("expected status 401, got %d", resp.StatusCode)
+		}
+	})
+}
+
+func TestLoadConfigTargets(t *testing.T) {
+	writeConfig := func(t *testing.T, content string) string {
+		t.Helper()
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatalf("failed to write config: %v", err)
+		}
+		return path
+	}
+
+	t.Run("top level settings become the default target", func(t *testing.T) {
+		path := writeConfig(t, `
+templatePath: /tmp/a.tmpl
+outputPath: /tmp/a.out
+command: /bin/true
+`)
+		cfg, err := loadConfig(path, "", "", "", "", "")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if len(cfg.Targets) != 1 {
+			t.Fatalf("expected 1 target, got %d", len(cfg.Targets))
+		}
+		if cfg.Targets[0].Name != "default" {
+			t.Errorf("expected target name 'default', got %q", cfg.Targets[0].Name)
+		}
+		if cfg.Targets[0].minNodeCount() != 1 {
+			t.Errorf("expected default minNodeCount 1, got %d", cfg.Targets[0].minNodeCount())
+		}
+	})
+
+	t.Run("targets inherit top level settings", func(t *testing.T) {
+		path := writeConfig(t, `
+command: /bin/true
+staticIPs: ["10.0.0.1"]
+minNodeCount: 2
+targets:
+  - name: nginx
+    templatePath: /tmp/nginx.tmpl
+    outputPath: /tmp/nginx.conf
+  - name: firewall
+    templatePath: /tmp/fw.tmpl
+    outputPath: /tmp/fw.rules
+    command: /usr/local/bin/reload-fw
+    staticIPs: []
+    minNodeCount: 0
+`)
+		cfg, err := loadConfig(path, "", "", "", "", "")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if len(cfg.Targets) != 2 {
+			t.Fatalf("expected 2 targets, got %d", len(cfg.Targets))
+		}
+
+		nginx, fw := cfg.Targets[0], cfg.Targets[1]
+		if nginx.Command[0] != "/bin/true" || len(nginx.StaticIPs) != 1 || nginx.minNodeCount() != 2 {
+			t.Errorf("nginx target did not inherit defaults: %+v", nginx)
+		}
+		if fw.Command[0] != "/usr/local/bin/reload-fw" || len(fw.StaticIPs) != 0 || fw.minNodeCount() != 0 {
+			t.Errorf("firewall target overrides not applied: %+v", fw)
+		}
+	})
+
+	t.Run("targets override defaults with zero", func(t *testing.T) {
+		path := writeConfig(t, `
+command: /bin/true
+templatePath: /tmp/a.tmpl
+commandTimeout: 30
+backupCount: 5
+targets:
+  - name: nginx
+    outputPath: /tmp/nginx.conf
+  - name: firewall
+    outputPath: /tmp/fw.rules
+    commandTimeout: 0
+    backupCount: 0
+`)
+		cfg, err := loadConfig(path, "", "", "", "", "")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		nginx, fw := cfg.Targets[0], cfg.Targets[1]
+		if nginx.commandTimeout() != 30*time.Second || nginx.backupCount() != 5 {
+			t.Errorf("nginx target did not inherit defaults: timeout %s, backups %d", nginx.commandTimeout(), nginx.backupCount())
+		}
+		if fw.commandTimeout() != 0 || fw.backupCount() != 0 {
+			t.Errorf("firewall target zero overrides not applied: timeout %s, backups %d", fw.commandTimeout(), fw.backupCount())
+		}
+	})
+
+	t.Run("duplicate output paths are rejected", func(t *testing.T) {
+		path := writeConfig(t, `
+command: /bin/true
+templatePath: /tmp/a.tmpl
+targets:
+  - name: a
+    outputPath: /tmp/same.out
+  - name: b
+    outputPath: /tmp/same.out
+`)
+		if _, err := loadConfig(path, "", "", "", "", ""); err == nil {
+			t.Error("expected error for duplicate outputPath")
+		}
+	})
+
+	t.Run("skipOutput does not need an outputPath", func(t *testing.T) {
+		path := writeConfig(t, `
+templatePath: /tmp/a.tmpl
+command: [/usr/local/bin/update-fw]
+commandStdin: output
+skipOutput: true
+`)
+		if _, err := loadConfig(path, "", "", "", "", ""); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("unknown commandStdin is rejected", func(t *testing.T) {
+		path := writeConfig(t, `
+templatePath: /tmp/a.tmpl
+outputPath: /tmp/a.out
+command: /bin/true
+commandStdin: xml
+`)
+		if _, err := loadConfig(path, "", "", "", "", ""); err == nil {
+			t.Error("expected error for unknown commandStdin")
+		}
+	})
+
+	t.Run("missing target name is rejected", func(t *testing.T) {
+		path := writeConfig(t, `
+targets:
+  - templatePath: /tmp/a.tmpl
+    outputPath: /tmp/a.out
+    command: /bin/true
+`)
+		if _, err := loadConfig(path, "", "", "", "", ""); err == nil {
+			t.Error("expected error for missing target name")
+		}
+	})
+	t.Run("admin token is read from tokenFile", func(t *testing.T) {
+		tokenFile := filepath.Join(t.TempDir(), "token")
+		if err := os.WriteFile(tokenFile, []byte("secret\n"), 0o600); err != nil {
+			t.Fatalf("failed to write token: %v", err)
+		}
+		path := writeConfig(t, `
+templatePath: /tmp/a.tmpl
+outputPath: /tmp/a.out
+command: /bin/true
+admin:
+  tokenFile: `+tokenFile+`
+`)
+		cfg, err := loadConfig(path, "", "", "", "", "")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if cfg.Admin.Token != "secret" {
+			t.Errorf("expected token from file, got %q", cfg.Admin.Token)
+		}
+	})
+}
+
+// newTestTarget creates a target rendering tmpl into a temp directory
+func newTestTarget(t *testing.T, name, tmpl string) *Target {
+	t.Helper()
+	dir := t.TempDir()
+	templatePath := filepath.Join(dir, name+".tmpl")
+	if err := os.WriteFile(templatePath, []byte(tmpl), 0o644); err != nil {
+		t.Fatalf("failed to write template: %v", err)
+	}
+
+	target, err := newTarget(TargetConfig{
+		Name:         name,
+		TemplatePath: templatePath,
+		OutputPath:   filepath.Join(dir, name+".out"),
+		Command:      CommandLine{"/bin/true"},
+	})
+	if err != nil {
+		t.Fatalf("failed to create target: %v", err)
+	}
+	return target
+}
+
+// setCommand replaces the command line of a target
+func setCommand(t *testing.T, target *Target, argv ...string) {
+	t.Helper()
+	target.config.Command = argv
+	args, err := target.config.Command.parseArgs()
+	if err != nil {
+		t.Fatalf("failed to parse command: %v", err)
+	}
+	target.args = args
+}
+
+// newTestWatcher creates a watcher without a kubernetes client
+func newTestWatcher(targets ...*Target) *Watcher {
+	w := &Watcher{
+		config:   &Config{},
+		logger:   slog.New(slog.NewTextHandler(io.Discard, nil)),
+		nodes:    make(map[string]NodeInfo),
+		targets:  targets,
+		store:    cache.NewStore(cache.MetaNamespaceKeyFunc),
+		rechecks: make(map[string]*time.Timer),
+		draining: make(map[string]*time.Timer),
+		settling: make(map[string]time.Time),
+	}
+	w.queue = w.newQueue()
+	return w
+}
+
+// processQueue applies the queued targets like the worker does
+func processQueue(w *Watcher) {
+	for w.queue.Len() > 0 {
+		w.processNextItem(context.Background())
+	}
+}
+
+func TestRenderAndExecuteTargets(t *testing.T) {
+	ips := newTestTarget(t, "ips", "{{ range .AllIPs }}{{ . }}\n{{ end }}")
+	names := newTestTarget(t, "names", "{{ range .Nodes }}{{ .Name }}\n{{ end }}")
+	w := newTestWatcher(ips, names)
+
+	w.nodes["node1"] = NodeInfo{Name: "node1", ExternalIP: "1.2.3.4", Addresses: []string{"1.2.3.4"}}
+	w.enqueueAll()
+	processQueue(w)
+
+	for _, tc := range []struct {
+		target *Target
+		want   string
+	}{
+		{ips, "1.2.3.4\n"},
+		{names, "node1\n"},
+	} {
+		got, err := os.ReadFile(tc.target.config.OutputPath)
+		if err != nil {
+			t.Fatalf("failed to read output of %s: %v", tc.target.config.Name, err)
+		}
+		if string(got) != tc.want {
+			t.Errorf("target %s: expected %q, got %q", tc.target.config.Name, tc.want, string(got))
+		}
+		if tc.target.appliedHash == "" {
+			t.Errorf("target %s: hash not recorded", tc.target.config.Name)
+		}
+	}
+
+	t.Run("target below minimum node count is skipped", func(t *testing.T) {
+		guarded := newTestTarget(t, "guarded", "{{ len .Nodes }}")
+		minNodes := 2
+		guarded.config.MinNodeCount = &minNodes
+		w.targets = append(w.targets, guarded)
+
+		w.enqueueAll()
+		processQueue(w)
+		if _, err := os.Stat(guarded.config.OutputPath); !os.IsNotExist(err) {
+			t.Error("expected guarded target not to be rendered")
+		}
+	})
+}
+
+// newTestNode creates a node with an external IP
+func newTestNode(name, ip string) *corev1.Node {
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status: corev1.NodeStatus{
+			Addresses: []corev1.NodeAddress{
+				{Type: corev1.NodeExternalIP, Address: ip},
+			},
+		},
+	}
+}
+
+func TestNodeSelector(t *testing.T) {
+	selector, err := newNodeSelector(NodeSelectorConfig{
+		LabelSelector:        "node-role=edge",
+		ExcludeTaints:        []string{"ToBeDeletedByClusterAutoscaler", "maintenance=true:NoExecute"},
+		ExcludeUnschedulable: true,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	edge := func(mutate func(*corev1.Node)) *corev1.Node {
+		node := newTestNode("node1", "1.2.3.4")
+		node.Labels = map[string]string{"node-role": "edge"}
+		if mutate != nil {
+			mutate(node)
+		}
+		return node
+	}
+
+	tests := []struct {
+		name string
+		node *corev1.Node
+		want bool
+	}{
+		{"matching node", edge(nil), true},
+		{"label mismatch", edge(func(n *corev1.Node) { n.Labels["node-role"] = "worker" }), false},
+		{"unschedulable", edge(func(n *corev1.Node) { n.Spec.Unschedulable = true }), false},
+		{"excluded taint key", edge(func(n *corev1.Node) {
+			n.Spec.Taints = []corev1.Taint{{Key: "ToBeDeletedByClusterAutoscaler", Effect: corev1.TaintEffectNoSchedule}}
+		}), false},
+		{"excluded taint value and effect", edge(func(n *corev1.Node) {
+			n.Spec.Taints = []corev1.Taint{{Key: "maintenance", Value: "true", Effect: corev1.TaintEffectNoExecute}}
+		}), false},
+		{"taint with other effect", edge(func(n *corev1.Node) {
+			n.Spec.Taints = []corev1.Taint{{Key: "maintenance", Value: "true", Effect: corev1.TaintEffectNoSchedule}}
+		}), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, reason := selector.matches(tt.node); got != tt.want {
+				t.Errorf("expected %v, got %v (reason %q)", tt.want, got, reason)
+			}
+		})
+	}
+
+	t.Run("invalid taint effect is rejected", func(t *testing.T) {
+		if _, err := newNodeSelector(NodeSelectorConfig{ExcludeTaints: []string{"key:Sometimes"}}); err == nil {
+			t.Error("expected error for invalid taint effect")
+		}
+	})
+
+	t.Run("invalid label selector is rejected", func(t *testing.T) {
+		if _, err := newNodeSelector(NodeSelectorConfig{LabelSelector: "a in (b"}); err == nil {
+			t.Error("expected error for invalid label selector")
+		}
+	})
+}
+
+func TestHandleNodeEventSelection(t *testing.T) {
+	target := newTestTarget(t, "ips", "{{ range .AllIPs }}{{ . }}\n{{ end }}")
+	w := newTestWatcher(target)
+
+	var err error
+	w.selector, err = newNodeSelector(NodeSelectorConfig{ExcludeUnschedulable: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	node1 := newTestNode("node1", "1.2.3.4")
+	w.handleNodeEvent("ADD", node1)
+	w.handleNodeEvent("ADD", newTestNode("node2", "5.6.7.8"))
+
+	cordoned := node1.DeepCopy()
+	cordoned.Spec.Unschedulable = true
+	w.handleNodeEvent("UPDATE", cordoned)
+	processQueue(w)
+
+	if _, exists := w.nodes["node1"]; exists {
+		t.Error("expected cordoned node to be removed")
+	}
+
+	got, err := os.ReadFile(target.config.OutputPath)
+	if err != nil {
+		t.Fatalf("failed to read output: %v", err)
+	}
+	if string(got) != "5.6.7.8\n" {
+		t.Errorf("expected re-render without cordoned node, got %q", string(got))
+	}
+
+	w.handleNodeEvent("UPDATE", node1)
+	if w.nodes["node1"].ExternalIP != "1.2.3.4" {
+		t.Error("expected uncordoned node to be added back")
+	}
+}
+
+// withReady sets the Ready condition of the node
+func withReady(node *corev1.Node, status corev1.ConditionStatus, since time.Time) *corev1.Node {
+	node.Status.Conditions = []corev1.NodeCondition{{
+		Type:               corev1.NodeReady,
+		Status:             status,
+		LastTransitionTime: metav1.NewTime(since),
+	}}
+	return node
+}
+
+func TestReadyState(t *testing.T) {
+	w := newTestWatcher()
+	w.config.Readiness = ReadinessConfig{
+		Enabled:             true,
+		NotReadyGracePeriod: 300,
+		ReadySettlePeriod:   60,
+	}
+	now := time.Now()
+
+	tests := []struct {
+		name        string
+		status      corev1.ConditionStatus
+		since       time.Duration
+		member      bool
+		wantReady   bool
+		wantRecheck bool
+	}{
+		{"ready member stays", corev1.ConditionTrue, time.Second, true, true, false},
+		{"ready non-member waits for settle", corev1.ConditionTrue, 10 * time.Second, false, false, true},
+		{"ready non-member added after settle", corev1.ConditionTrue, 2 * time.Minute, false, true, false},
+		{"not ready member kept during grace", corev1.ConditionFalse, time.Minute, true, true, true},
+		{"not ready member removed after grace", corev1.ConditionFalse, 10 * time.Minute, true, false, false},
+		{"unknown member removed after grace", corev1.ConditionUnknown, 10 * time.Minute, true, false, false},
+		{"not ready non-member stays out", corev1.ConditionFalse, time.Minute, false, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node := withReady(newTestNode("node1", "1.2.3.4"), tt.status, now.Add(-tt.since))
+			ready, recheckAt := w.readyState(node, tt.member, now)
+			if ready != tt.wantReady {
+				t.Errorf("expected ready %v, got %v", tt.wantReady, ready)
+			}
+			if recheckAt.IsZero() == tt.wantRecheck {
+				t.Errorf("expected recheck %v, got %v", tt.wantRecheck, recheckAt)
+			}
+		})
+	}
+
+	t.Run("disabled always includes", func(t *testing.T) {
+		w := newTestWatcher()
+		node := withReady(newTestNode("node1", "1.2.3.4"), corev1.ConditionFalse, now.Add(-time.Hour))
+		if ready, _ := w.readyState(node, false, now); !ready {
+			t.Error("expected node to be included when readiness is disabled")
+		}
+	})
+}
+
+func TestReadinessGraceExpiry(t *testing.T) {
+	target := newTestTarget(t, "ips", "{{ range .AllIPs }}{{ . }}\n{{ end }}")
+	w := newTestWatcher(target)
+	w.config.Readiness = ReadinessConfig{Enabled: true, NotReadyGracePeriod: 1}
+
+	w.handleNodeEvent("ADD", withReady(newTestNode("node1", "1.2.3.4"), corev1.ConditionTrue, time.Now().Add(-time.Hour)))
+	w.handleNodeEvent("ADD", withReady(newTestNode("node2", "5.6.7.8"), corev1.ConditionTrue, time.Now().Add(-time.Hour)))
+
+	// The grace period expires shortly, without any further events
+	notReady := withReady(newTestNode("node1", "1.2.3.4"), corev1.ConditionFalse, time.Now().Add(-900*time.Millisecond))
+	if err := w.store.Add(notReady); err != nil {
+		t.Fatalf("failed to add node to store: %v", err)
+	}
+	w.handleNodeEvent("UPDATE", notReady)
+
+	w.mu.RLock()
+	_, kept := w.nodes["node1"]
+	w.mu.RUnlock()
+	if !kept {
+		t.Fatal("expected not ready node to be kept during grace period")
+	}
+
+	time.Sleep(300 * time.Millisecond)
+
+	w.mu.RLock()
+	_, kept = w.nodes["node1"]
+	w.mu.RUnlock()
+	if kept {
+		t.Error("expected not ready node to be removed after grace period")
+	}
+
+	w.stopRechecks()
+}
+
+func TestDampening(t *testing.T) {
+	member := func(w *Watcher, name string) (NodeInfo, bool) {
+		w.mu.RLock()
+		defer w.mu.RUnlock()
+		info, ok := w.nodes[name]
+		return info, ok
+	}
+
+	t.Run("removal is delayed and cancelled when the node returns", func(t *testing.T) {
+		w := newTestWatcher()
+		w.config.Dampening = DampeningConfig{RemovalDelay: 60, MarkDraining: true}
+		defer w.stopDraining()
+
+		w.handleNodeEvent("ADD", newTestNode("node1", "1.2.3.4"))
+		w.handleNodeEvent("DELETE", newTestNode("node1", "1.2.3.4"))
+
+		info, ok := member(w, "node1")
+		if !ok || !info.Draining {
+			t.Fatalf("expected deleted node to be kept as draining, got %+v", info)
+		}
+
+		w.handleNodeEvent("ADD", newTestNode("node1", "1.2.3.4"))
+		info, ok = member(w, "node1")
+		if !ok || info.Draining {
+			t.Errorf("expected returned node to no longer be draining, got %+v", info)
+		}
+		if len(w.draining) != 0 {
+			t.Error("expected delayed removal to be cancelled")
+		}
+	})
+
+	t.Run("node is removed once the delay expires", func(t *testing.T) {
+		target := newTestTarget(t, "ips", "{{ range .AllIPs }}{{ . }}\n{{ end }}")
+		w := newTestWatcher(target)
+		w.config.Dampening = DampeningConfig{RemovalDelay: 1}
+		defer w.stopDraining()
+
+		w.handleNodeEvent("ADD", newTestNode("node1", "1.2.3.4"))
+		w.handleNodeEvent("ADD", newTestNode("node2", "5.6.7.8"))
+		processQueue(w)
+
+		// Losing its address starts the delay, without marking it
+		noAddresses := newTestNode("node1", "1.2.3.4")
+		noAddresses.Status.Addresses = nil
+		w.handleNodeEvent("UPDATE", noAddresses)
+		if info, ok := member(w, "node1"); !ok || info.Draining || w.queue.Len() != 0 {
+			t.Fatalf("expected node kept unchanged during the delay, got %+v", info)
+		}
+
+		time.Sleep(1200 * time.Millisecond)
+		if _, ok := member(w, "node1"); ok {
+			t.Fatal("expected node to be removed after the delay")
+		}
+		processQueue(w)
+
+		got, err := os.ReadFile(target.config.OutputPath)
+		if err != nil {
+			t.Fatalf("failed to read output: %v", err)
+		}
+		if string(got) != "5.6.7.8\n" {
+			t.Errorf("expected removal to be applied, got %q", string(got))
+		}
+	})
+
+	t.Run("new nodes settle before being added", func(t *testing.T) {
+		w := newTestWatcher()
+		w.config.Dampening = DampeningConfig{AddDelay: 1}
+		defer w.stopRechecks()
+
+		node := newTestNode("node1", "1.2.3.4")
+		if err := w.store.Add(node); err != nil {
+			t.Fatalf("failed to add node to store: %v", err)
+		}
+		w.handleNodeEvent("ADD", node)
+		if _, ok := member(w, "node1"); ok {
+			t.Fatal("expected new node to settle before being added")
+		}
+
+		time.Sleep(1200 * time.Millisecond)
+		if _, ok := member(w, "node1"); !ok {
+			t.Error("expected node to be added after the settle delay")
+		}
+	})
+}
+
+func TestNodeInfoAddressTypes(t *testing.T) {
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node1"},
+		Status: corev1.NodeStatus{
+			Addresses: []corev1.NodeAddress{
+				{Type: corev1.NodeInternalIP, Address: "10.0.0.1"},
+				{Type: corev1.NodeInternalIP, Address: "fd00::1"},
+				{Type: corev1.NodeHostName, Address: "node1.example.com"},
+			},
+		},
+	}
+
+	tests := []struct {
+		name         string
+		addressTypes []string
+		want         []string
+		wantType     string
+	}{
+		{"default has no external IP", nil, nil, ""},
+		{"falls back to internal IP", []string{"ExternalIP", "InternalIP"}, []string{"10.0.0.1", "fd00::1"}, "InternalIP"},
+		{"first matching type wins", []string{"Hostname", "InternalIP"}, []string{"node1.example.com"}, "Hostname"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := newTestWatcher()
+			w.config.AddressTypes = tt.addressTypes
+
+			info := w.nodeInfo(node)
+			if !slices.Equal(info.Addresses, tt.want) {
+				t.Errorf("expected addresses %v, got %v", tt.want, info.Addresses)
+			}
+			if info.AddressType != tt.wantType {
+				t.Errorf("expected address type %q, got %q", tt.wantType, info.AddressType)
+			}
+			if len(tt.want) > 0 && info.ExternalIP != tt.want[0] {
+				t.Errorf("expected ExternalIP %q, got %q", tt.want[0], info.ExternalIP)
+			}
+		})
+	}
+}
+
+func TestHandleNodeEventAddresses(t *testing.T) {
+	target := newTestTarget(t, "ips", "{{ range .Nodes }}{{ .Name }}{{ range .Addresses }} {{ . }}{{ end }}\n{{ end }}")
+	w := newTestWatcher(target)
+
+	node := newTestNode("node1", "1.2.3.4")
+	node.Status.Addresses = append(node.Status.Addresses, corev1.NodeAddress{Type: corev1.NodeExternalIP, Address: "2001:db8::1"})
+	w.handleNodeEvent("ADD", node)
+	processQueue(w)
+
+	got, err := os.ReadFile(target.config.OutputPath)
+	if err != nil {
+		t.Fatalf("failed to read output: %v", err)
+	}
+	if string(got) != "node1 1.2.3.4 2001:db8::1\n" {
+		t.Errorf("expected all addresses rendered, got %q", string(got))
+	}
+
+	// Losing all matching addresses removes the node
+	w.handleNodeEvent("UPDATE", &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}})
+	if _, exists := w.nodes["node1"]; exists {
+		t.Error("expected node without addresses to be removed")
+	}
+}
+
+func TestLoadConfigAddressTypes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	content := `
+templatePath: /tmp/a.tmpl
+outputPath: /tmp/a.out
+command: /bin/true
+addressTypes: [ExternalIP, PublicIP]
+`
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+
+	if _, err := loadConfig(path, "", "", "", "", ""); err == nil {
+		t.Error("expected error for unknown address type")
+	}
+}
+
+func TestNodeDataIPFamilies(t *testing.T) {
+	dualStack := func(name, v4, v6 string) NodeInfo {
+		return NodeInfo{
+			Name:       name,
+			ExternalIP: v4,
+			Addresses:  []string{v4, v6},
+			IPv4:       []string{v4},
+			IPv6:       []string{v6},
+		}
+	}
+
+	w := newTestWatcher()
+	w.nodes["node1"] = dualStack("node1", "1.2.3.4", "2001:db8::1")
+	w.nodes["node2"] = NodeInfo{Name: "node2", ExternalIP: "5.6.7.8", Addresses: []string{"5.6.7.8"}, IPv4: []string{"5.6.7.8"}}
+	staticIPs := []string{"10.0.0.1", "fd00::1"}
+
+	t.Run("no family keeps both", func(t *testing.T) {
+		data := w.nodeData(&Target{config: TargetConfig{StaticIPs: staticIPs}})
+		if len(data.Nodes) != 2 || len(data.AllIPs) != 5 {
+			t.Errorf("expected 2 nodes and 5 IPs, got %d and %d", len(data.Nodes), len(data.AllIPs))
+		}
+		if len(data.AllIPv4) != 3 || len(data.AllIPv6) != 2 {
+			t.Errorf("expected 3 IPv4 and 2 IPv6, got %v and %v", data.AllIPv4, data.AllIPv6)
+		}
+	})
+
+	t.Run("ipv6 only", func(t *testing.T) {
+		data := w.nodeData(&Target{config: TargetConfig{StaticIPs: staticIPs, IPFamily: ipv6}})
+		if len(data.Nodes) != 1 {
+			t.Fatalf("expected only the dual stack node, got %+v", data.Nodes)
+		}
+		node := data.Nodes[0]
+		if node.ExternalIP != "2001:db8::1" || len(node.IPv4) != 0 {
+			t.Errorf("expected node restricted to IPv6, got %+v", node)
+		}
+		if !slices.Equal(data.StaticIPs, []string{"fd00::1"}) || len(data.AllIPv4) != 0 {
+			t.Errorf("expected only IPv6 static IPs, got %v", data.StaticIPs)
+		}
+	})
+}
+
+func TestSplitIPFamilies(t *testing.T) {
+	v4, v6 := splitIPFamilies([]string{"1.2.3.4", "2001:db8::1", "::ffff:5.6.7.8", "node1.example.com"})
+	if !slices.Equal(v4, []string{"1.2.3.4", "::ffff:5.6.7.8"}) {
+		t.Errorf("unexpected IPv4 addresses: %v", v4)
+	}
+	if !slices.Equal(v6, []string{"2001:db8::1"}) {
+		t.Errorf("unexpected IPv6 addresses: %v", v6)
+	}
+}
+
+func TestNodeInfoMetadata(t *testing.T) {
+	node := newTestNode("node1", "1.2.3.4")
+	node.Labels = map[string]string{
+		corev1.LabelTopologyZone:   "fr-par-1",
+		corev1.LabelTopologyRegion: "fr-par",
+		"pool":                     "edge",
+	}
+	node.Spec.ProviderID = "scaleway://instance/fr-par-1/abc"
+	node.Spec.Taints = []corev1.Taint{{Key: "dedicated", Value: "edge", Effect: corev1.TaintEffectNoSchedule}}
+	node.Status.NodeInfo = corev1.NodeSystemInfo{KubeletVersion: "v1.34.1", OperatingSystem: "linux", Architecture: "arm64"}
+	node = withReady(node, corev1.ConditionTrue, time.Now())
+
+	info := newTestWatcher().nodeInfo(node)
+
+	if info.Zone != "fr-par-1" || info.Region != "fr-par" || info.Labels["pool"] != "edge" {
+		t.Errorf("unexpected topology or labels: %+v", info)
+	}
+	if info.ProviderID != node.Spec.ProviderID || info.KubeletVersion != "v1.34.1" || info.OS != "linux" || info.Arch != "arm64" {
+		t.Errorf("unexpected node system info: %+v", info)
+	}
+	if info.Conditions["Ready"] != "True" {
+		t.Errorf("expected Ready condition True, got %v", info.Conditions)
+	}
+	if len(info.Taints) != 1 || info.Taints[0].Key != "dedicated" {
+		t.Errorf("unexpected taints: %v", info.Taints)
+	}
+}
+
+func TestCalculateHashFields(t *testing.T) {
+	data := func(zone string) NodeData {
+		return NodeData{Nodes: []NodeInfo{{Name: "node1", ExternalIP: "1.2.3.4", Zone: zone, Labels: map[string]string{"zone": zone}}}}
+	}
+
+	t.Run("metadata ignored by default", func(t *testing.T) {
+		w := &Watcher{}
+		if w.calculateHash(data("a")) != w.calculateHash(data("b")) {
+			t.Error("metadata affected hash without hashFields")
+		}
+	})
+
+	for _, field := range []string{hashFieldZone, hashFieldLabels} {
+		t.Run(field+" included when configured", func(t *testing.T) {
+			w := &Watcher{hashFields: map[string]bool{field: true}}
+			if w.calculateHash(data("a")) == w.calculateHash(data("b")) {
+				t.Errorf("%s change did not affect hash", field)
+			}
+		})
+	}
+}
+
+func TestHandleNodeEventMetadata(t *testing.T) {
+	target := newTestTarget(t, "zones", "{{ range .Nodes }}{{ .Name }} {{ .Zone }}\n{{ end }}")
+	w := newTestWatcher(target)
+
+	node := newTestNode("node1", "1.2.3.4")
+	node.Labels = map[string]string{corev1.LabelTopologyZone: "a"}
+	w.handleNodeEvent("ADD", node)
+	processQueue(w)
+	hash := target.appliedHash
+
+	moved := node.DeepCopy()
+	moved.Labels[corev1.LabelTopologyZone] = "b"
+	w.handleNodeEvent("UPDATE", moved)
+	processQueue(w)
+
+	if w.nodes["node1"].Zone != "b" {
+		t.Error("expected stored node info to be updated")
+	}
+	if target.appliedHash != hash {
+		t.Error("expected no re-render for metadata not in hashFields")
+	}
+
+	w.hashFields = map[string]bool{hashFieldZone: true}
+	node.Labels[corev1.LabelTopologyZone] = "c"
+	w.handleNodeEvent("UPDATE", node)
+	processQueue(w)
+
+	got, err := os.ReadFile(target.config.OutputPath)
+	if err != nil {
+		t.Fatalf("failed to read output: %v", err)
+	}
+	if string(got) != "node1 c\n" {
+		t.Errorf("expected re-render with new zone, got %q", string(got))
+	}
+}
+
+func TestNodeDataOrdering(t *testing.T) {
+	w := newTestWatcher()
+	now := time.Now()
+	for _, n := range []struct {
+		name, ip, pool string
+		age            time.Duration
+	}{
+		{"node-b", "10.0.0.10", "a", time.Hour},
+		{"node-a", "10.0.0.9", "b", time.Minute},
+		{"node-c", "10.0.0.100", "a", 2 * time.Hour},
+	} {
+		w.nodes[n.name] = NodeInfo{
+			Name:         n.name,
+			ExternalIP:   n.ip,
+			Addresses:    []string{n.ip},
+			Labels:       map[string]string{"pool": n.pool},
+			CreationTime: now.Add(-n.age),
+		}
+	}
+
+	names := func(nodes []NodeInfo) []string {
+		out := make([]string, 0, len(nodes))
+		for _, n := range nodes {
+			out = append(out, n.Name)
+		}
+		return out
+	}
+
+	tests := []struct {
+		sortBy string
+		want   []string
+	}{
+		{"", []string{"node-a", "node-b", "node-c"}},
+		{sortByName, []string{"node-a", "node-b", "node-c"}},
+		{sortByIP, []string{"node-a", "node-b", "node-c"}},
+		{sortByCreationTime, []string{"node-c", "node-b", "node-a"}},
+		{"label:pool", []string{"node-b", "node-c", "node-a"}},
+	}
+
+	for _, tt := range tests {
+		t.Run("sortBy "+tt.sortBy, func(t *testing.T) {
+			// Repeat to catch map iteration order leaking through
+			for range 10 {
+				data := w.nodeData(&Target{config: TargetConfig{SortBy: tt.sortBy}})
+				if got := names(data.Nodes); !slices.Equal(got, tt.want) {
+					t.Fatalf("expected %v, got %v", tt.want, got)
+				}
+			}
+		})
+	}
+
+	t.Run("AllIPs sorted numerically and de-duplicated", func(t *testing.T) {
+		data := w.nodeData(&Target{config: TargetConfig{StaticIPs: []string{"10.0.0.10", "2001:db8::1", "10.0.0.2"}}})
+		want := []string{"10.0.0.2", "10.0.0.9", "10.0.0.10", "10.0.0.100", "2001:db8::1"}
+		if !slices.Equal(data.AllIPs, want) {
+			t.Errorf("expected %v, got %v", want, data.AllIPs)
+		}
+	})
+}
+
+func TestParseTemplate(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatalf("failed to write template: %v", err)
+		}
+		return path
+	}
+
+	write("lib/header.tmpl", `{{ define "header" }}# generated{{ end }}`)
+	write("lib/upstream.tmpl", `{{ define "upstream" }}{{ range .Nodes }} {{ .ExternalIP }}{{ end }}{{ end }}`)
+	nginx := write("targets/nginx.tmpl", `{{ template "header" }}|nginx{{ template "upstream" . }}`)
+	write("targets/haproxy.tmpl", `{{ template "header" }}|haproxy{{ template "upstream" . }}`)
+	write("combined.tmpl", `{{ define "main" }}{{ template "header" }}|main{{ end }}`)
+
+	data := NodeData{Nodes: []NodeInfo{{Name: "node1", ExternalIP: "1.2.3.4"}}}
+	render := func(t *testing.T, cfg TargetConfig) string {
+		t.Helper()
+		tmpl, err := parseTemplate(cfg)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		var b strings.Builder
+		if err := tmpl.Execute(&b, data); err != nil {
+			t.Fatalf("failed to execute template: %v", err)
+		}
+		return b.String()
+	}
+
+	t.Run("single file with includes directory", func(t *testing.T) {
+		got := render(t, TargetConfig{TemplatePath: nginx, TemplateIncludes: []string{filepath.Join(dir, "lib")}})
+		if got != "# generated|nginx 1.2.3.4" {
+			t.Errorf("unexpected output %q", got)
+		}
+	})
+
+	t.Run("glob with template name", func(t *testing.T) {
+		got := render(t, TargetConfig{
+			TemplatePath:     filepath.Join(dir, "targets", "*.tmpl"),
+			TemplateIncludes: []string{filepath.Join(dir, "lib", "*.tmpl")},
+			TemplateName:     "haproxy.tmpl",
+		})
+		if got != "# generated|haproxy 1.2.3.4" {
+			t.Errorf("unexpected output %q", got)
+		}
+	})
+
+	t.Run("entry from define block", func(t *testing.T) {
+		got := render(t, TargetConfig{
+			TemplatePath:     filepath.Join(dir, "combined.tmpl"),
+			TemplateIncludes: []string{filepath.Join(dir, "lib")},
+			TemplateName:     "main",
+		})
+		if got != "# generated|main" {
+			t.Errorf("unexpected output %q", got)
+		}
+	})
+
+	t.Run("directory mounted from a ConfigMap", func(t *testing.T) {
+		// Files are symlinks into a hidden, timestamped data directory
+		cm := filepath.Join(dir, "configmap")
+		write("configmap/..2025_06_02_10_14_03.123/header.tmpl", `{{ define "header" }}# configmap{{ end }}`)
+		write("configmap/.header.tmpl.swp", "not a template {{")
+		if err := os.Symlink("..2025_06_02_10_14_03.123", filepath.Join(cm, "..data")); err != nil {
+			t.Fatalf("failed to create symlink: %v", err)
+		}
+		if err := os.Symlink(filepath.Join("..data", "header.tmpl"), filepath.Join(cm, "header.tmpl")); err != nil {
+			t.Fatalf("failed to create symlink: %v", err)
+		}
+
+		got := render(t, TargetConfig{TemplatePath: nginx, TemplateIncludes: []string{cm, filepath.Join(dir, "lib", "upstream.tmpl")}})
+		if got != "# configmap|nginx 1.2.3.4" {
+			t.Errorf("unexpected output %q", got)
+		}
+	})
+
+	t.Run("glob without template name fails", func(t *testing.T) {
+		if _, err := parseTemplate(TargetConfig{TemplatePath: filepath.Join(dir, "targets")}); err == nil {
+			t.Error("expected error when templateName is missing")
+		}
+	})
+
+	t.Run("unknown template name fails", func(t *testing.T) {
+		if _, err := parseTemplate(TargetConfig{TemplatePath: nginx, TemplateName: "missing"}); err == nil {
+			t.Error("expected error for unknown templateName")
+		}
+	})
+
+	t.Run("missing file fails", func(t *testing.T) {
+		if _, err := parseTemplate(TargetConfig{TemplatePath: filepath.Join(dir, "missing.tmpl")}); err == nil {
+			t.Error("expected error for missing template file")
+		}
+	})
+}
+
+// writeScript writes an executable shell script into dir
+func writeScript(t *testing.T, dir, name, body string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+body+"\n"), 0o755); err != nil {
+		t.Fatalf("failed to write script: %v", err)
+	}
+	return path
+}
+
+func TestRetryBackoff(t *testing.T) {
+	w := newTestWatcher()
+	w.config.Retry = RetryConfig{InitialInterval: 1, MaxInterval: 10}
+
+	tests := []struct {
+		failures int
+		base     time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{4, 8 * time.Second},
+		{10, 10 * time.Second},
+	}
+
+	for _, tt := range tests {
+		delay := w.retryBackoff(tt.failures)
+		low := time.Duration(float64(tt.base) * 0.8)
+		high := time.Duration(float64(tt.base) * 1.2)
+		if delay < low || delay > high {
+			t.Errorf("failures %d: expected delay within [%v, %v], got %v", tt.failures, low, high, delay)
+		}
+	}
+}
+
+func TestReconcileRetriesFailedCommand(t *testing.T) {
+	target := newTestTarget(t, "ips", "{{ range .AllIPs }}{{ . }}\n{{ end }}")
+	dir := filepath.Dir(target.config.OutputPath)
+	okFile := filepath.Join(dir, "ok")
+	setCommand(t, target, writeScript(t, dir, "reload.sh", "test -f "+okFile))
+
+	w := newTestWatcher(target)
+	w.config.Retry = RetryConfig{InitialInterval: 1, MaxInterval: 1}
+	defer w.queue.ShutDown()
+
+	w.handleNodeEvent("ADD", newTestNode("node1", "1.2.3.4"))
+	processQueue(w)
+
+	target.mu.Lock()
+	pending := target.appliedHash != target.desiredHash
+	target.mu.Unlock()
+	if !pending || w.queue.NumRequeues("ips") != 1 {
+		t.Fatal("expected failed command to leave a pending retry")
+	}
+
+	go w.runWorker(context.Background())
+
+	// Let the command succeed, the retry must apply without new events
+	if err := os.WriteFile(okFile, nil, 0o644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		target.mu.Lock()
+		applied := target.appliedHash == target.desiredHash
+		target.mu.Unlock()
+		if applied && w.queue.NumRequeues("ips") == 0 {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Error("expected retry to apply the pending change")
+}
+
+func TestEventsCollapseIntoSingleApply(t *testing.T) {
+	target := newTestTarget(t, "ips", "{{ range .AllIPs }}{{ . }}\n{{ end }}")
+	dir := filepath.Dir(target.config.OutputPath)
+	countFile := filepath.Join(dir, "count")
+	setCommand(t, target, writeScript(t, dir, "reload.sh", "echo run >> "+countFile))
+
+	w := newTestWatcher(target)
+	for i := range 10 {
+		w.handleNodeEvent("ADD", newTestNode(fmt.Sprintf("node%d", i), fmt.Sprintf("10.0.0.%d", i)))
+	}
+
+	if w.queue.Len() != 1 {
+		t.Fatalf("expected a single queued apply, got %d", w.queue.Len())
+	}
+	processQueue(w)
+
+	got, err := os.ReadFile(countFile)
+	if err != nil {
+		t.Fatalf("failed to read count file: %v", err)
+	}
+	if runs := strings.Count(string(got), "run"); runs != 1 {
+		t.Errorf("expected command to run once, ran %d times", runs)
+	}
+}
+
+func TestDebounce(t *testing.T) {
+	t.Run("quiet period holds back changes", func(t *testing.T) {
+		w := newTestWatcher(newTestTarget(t, "ips", "{{ len .Nodes }}"))
+		w.config.Debounce = DebounceConfig{QuietPeriod: 1}
+		defer w.stopDebounce()
+
+		w.handleNodeEvent("ADD", newTestNode("node1", "1.2.3.4"))
+		if w.queue.Len() != 0 {
+			t.Fatal("expected no apply queued during quiet period")
+		}
+
+		time.Sleep(1200 * time.Millisecond)
+		if w.queue.Len() != 1 {
+			t.Error("expected apply queued after quiet period")
+		}
+	})
+
+	t.Run("max wait bounds the delay", func(t *testing.T) {
+		w := newTestWatcher(newTestTarget(t, "ips", "{{ len .Nodes }}"))
+		w.config.Debounce = DebounceConfig{QuietPeriod: 10, MaxWait: 1}
+		defer w.stopDebounce()
+
+		w.mu.Lock()
+		w.burstStart = time.Now().Add(-900 * time.Millisecond)
+		w.mu.Unlock()
+		w.handleNodeEvent("ADD", newTestNode("node1", "1.2.3.4"))
+
+		time.Sleep(300 * time.Millisecond)
+		if w.queue.Len() != 1 {
+			t.Error("expected apply queued once max wait passed")
+		}
+	})
+
+	t.Run("min command interval delays apply", func(t *testing.T) {
+		target := newTestTarget(t, "ips", "{{ len .Nodes }}")
+		w := newTestWatcher(target)
+		w.config.Debounce = DebounceConfig{MinCommandInterval: 60}
+		defer w.queue.ShutDown()
+
+		w.handleNodeEvent("ADD", newTestNode("node1", "1.2.3.4"))
+		processQueue(w)
+
+		w.handleNodeEvent("ADD", newTestNode("node2", "5.6.7.8"))
+		processQueue(w)
+
+		got, err := os.ReadFile(target.config.OutputPath)
+		if err != nil {
+			t.Fatalf("failed to read output: %v", err)
+		}
+		if string(got) != "1" {
+			t.Errorf("expected second apply to be delayed, got output %q", string(got))
+		}
+		if wait := w.commandCooldown("ips"); wait <= 0 || wait > time.Minute {
+			t.Errorf("unexpected cooldown %v", wait)
+		}
+	})
+}
+
+func TestCommandTimeout(t *testing.T) {
+	target := newTestTarget(t, "ips", "{{ len .Nodes }}")
+	dir := filepath.Dir(target.config.OutputPath)
+	childPid := filepath.Join(dir, "child.pid")
+	// The child keeps running unless the whole process group is killed
+	setCommand(t, target, writeScript(t, dir, "hang.sh", "sleep 30 &\necho $! > "+childPid+"\nwait"))
+	timeout := 1
+	target.config.CommandTimeout = &timeout
+
+	w := newTestWatcher(target)
+	w.handleNodeEvent("ADD", newTestNode("node1", "1.2.3.4"))
+
+	start := time.Now()
+	target.mu.Lock()
+	err := w.executeCommand(context.Background(), target, CommandData{}, nil)
+	target.mu.Unlock()
+
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("expected timeout error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected command to be killed after the timeout, took %v", elapsed)
+	}
+
+	pid, err := os.ReadFile(childPid)
+	if err != nil {
+		t.Fatalf("failed to read child pid: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	// A killed child may linger as a zombie until its new parent reaps it
+	out, err := exec.Command("ps", "-o", "stat=", "-p", strings.TrimSpace(string(pid))).Output()
+	if err == nil && !strings.HasPrefix(strings.TrimSpace(string(out)), "Z") {
+		t.Error("expected child process to be killed with the process group")
+	}
+}
+
+func TestCommandKilledOnShutdown(t *testing.T) {
+	target := newTestTarget(t, "ips", "{{ len .Nodes }}")
+	setCommand(t, target, writeScript(t, filepath.Dir(target.config.OutputPath), "hang.sh", "sleep 30"))
+	w := newTestWatcher(target)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+
+	target.mu.Lock()
+	err := w.executeCommand(ctx, target, CommandData{}, nil)
+	target.mu.Unlock()
+
+	if err == nil || !strings.Contains(err.Error(), "shutdown") {
+		t.Errorf("expected command killed on shutdown, got %v", err)
+	}
 }
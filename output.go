@@ -0,0 +1,137 @@
+// Copyright 2025 Fredrik Steen <fredrik@tty.se>
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+)
+
+// defaultOutputMode is used for new output files without a configured mode
+const defaultOutputMode fs.FileMode = 0o644
+
+// outputOwnership is the resolved file mode and ownership of an output file
+type outputOwnership struct {
+	mode fs.FileMode // 0 keeps the mode of the existing output
+	uid  int         // -1 leaves unchanged
+	gid  int         // -1 leaves unchanged
+}
+
+// newOutputOwnership resolves the configured output mode, owner and group.
+// Owner and group can be names or numeric IDs.
+func newOutputOwnership(cfg TargetConfig) (outputOwnership, error) {
+	o := outputOwnership{uid: -1, gid: -1}
+
+	if cfg.OutputMode != "" {
+		mode, err := strconv.ParseUint(cfg.OutputMode, 8, 32)
+		if err != nil || mode > 0o7777 {
+			return o, fmt.Errorf("invalid outputMode %q, must be octal like 0644", cfg.OutputMode)
+		}
+		o.mode = fs.FileMode(mode)
+	}
+
+	if cfg.OutputOwner != "" {
+		uid, err := strconv.Atoi(cfg.OutputOwner)
+		if err != nil {
+			u, err := user.Lookup(cfg.OutputOwner)
+			if err != nil {
+				return o, fmt.Errorf("lookup outputOwner: %w", err)
+			}
+			uid, _ = strconv.Atoi(u.Uid)
+		}
+		o.uid = uid
+	}
+
+	if cfg.OutputGroup != "" {
+		gid, err := strconv.Atoi(cfg.OutputGroup)
+		if err != nil {
+			g, err := user.LookupGroup(cfg.OutputGroup)
+			if err != nil {
+				return o, fmt.Errorf("lookup outputGroup: %w", err)
+			}
+			gid, _ = strconv.Atoi(g.Gid)
+		}
+		o.gid = gid
+	}
+
+	return o, nil
+}
+
+// renderTemp renders into a new temporary file next to the output path, so
+// it can be renamed over the output. The file is synced and has the output
+// mode and ownership applied. The caller must remove it if not committed.
+func (t *Target) renderTemp(render func(io.Writer) error) (string, error) {
+	path := t.config.OutputPath
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return "", fmt.Errorf("create temp file: %w", err)
+	}
+
+	tmpPath := f.Name()
+	fail := func(err error) (string, error) {
+		f.Close()
+		os.Remove(tmpPath)
+		return "", err
+	}
+
+	if err := render(f); err != nil {
+		return fail(err)
+	}
+
+	if err := f.Chmod(t.outputMode()); err != nil {
+		return fail(fmt.Errorf("chmod temp file: %w", err))
+	}
+
+	if t.ownership.uid >= 0 || t.ownership.gid >= 0 {
+		if err := f.Chown(t.ownership.uid, t.ownership.gid); err != nil {
+			return fail(fmt.Errorf("chown temp file: %w", err))
+		}
+	}
+
+	if err := f.Sync(); err != nil {
+		return fail(fmt.Errorf("sync temp file: %w", err))
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(tmpPath)
+		return "", fmt.Errorf("close temp file: %w", err)
+	}
+
+	return tmpPath, nil
+}
+
+// commitOutput atomically replaces the output file with the temporary file
+func (t *Target) commitOutput(tmpPath string) error {
+	if err := os.Rename(tmpPath, t.config.OutputPath); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("rename output file: %w", err)
+	}
+
+	// Sync the directory so the rename survives a crash
+	dir, err := os.Open(filepath.Dir(t.config.OutputPath))
+	if err != nil {
+		return fmt.Errorf("open output directory: %w", err)
+	}
+	defer dir.Close()
+
+	if err := dir.Sync(); err != nil {
+		return fmt.Errorf("sync output directory: %w", err)
+	}
+
+	return nil
+}
+
+// outputMode returns the configured mode, or the mode of the existing output
+func (t *Target) outputMode() fs.FileMode {
+	if t.ownership.mode != 0 {
+		return t.ownership.mode
+	}
+	if info, err := os.Stat(t.config.OutputPath); err == nil {
+		return info.Mode().Perm()
+	}
+	return defaultOutputMode
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestWriteOutput(t *testing.T) {
+	write := func(t *testing.T, target *Target, content string) error {
+		t.Helper()
+		tmpPath, err := target.renderTemp(func(w io.Writer) error {
+			_, err := io.WriteString(w, content)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		return target.commitOutput(tmpPath)
+	}
+
+	t.Run("replaces output and leaves no temp files", func(t *testing.T) {
+		target := newTestTarget(t, "out", "")
+		if err := write(t, target, "first"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := write(t, target, "second"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		got, err := os.ReadFile(target.config.OutputPath)
+		if err != nil {
+			t.Fatalf("failed to read output: %v", err)
+		}
+		if string(got) != "second" {
+			t.Errorf("expected %q, got %q", "second", string(got))
+		}
+
+		entries, err := os.ReadDir(filepath.Dir(target.config.OutputPath))
+		if err != nil {
+			t.Fatalf("failed to read directory: %v", err)
+		}
+		for _, entry := range entries {
+			if entry.Name() != "out.tmpl" && entry.Name() != "out.out" {
+				t.Errorf("unexpected file left behind: %s", entry.Name())
+			}
+		}
+	})
+
+	t.Run("failed render keeps last good output", func(t *testing.T) {
+		target := newTestTarget(t, "out", "")
+		if err := write(t, target, "good"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		_, err := target.renderTemp(func(w io.Writer) error {
+			io.WriteString(w, "half")
+			return fmt.Errorf("template failed")
+		})
+		if err == nil {
+			t.Fatal("expected render error")
+		}
+
+		got, err := os.ReadFile(target.config.OutputPath)
+		if err != nil {
+			t.Fatalf("failed to read output: %v", err)
+		}
+		if string(got) != "good" {
+			t.Errorf("expected last good output, got %q", string(got))
+		}
+	})
+
+	t.Run("configured mode is applied", func(t *testing.T) {
+		target := newTestTarget(t, "out", "")
+		ownership, err := newOutputOwnership(TargetConfig{OutputMode: "0640"})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		target.ownership = ownership
+
+		if err := write(t, target, "content"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		info, err := os.Stat(target.config.OutputPath)
+		if err != nil {
+			t.Fatalf("failed to stat output: %v", err)
+		}
+		if info.Mode().Perm() != 0o640 {
+			t.Errorf("expected mode 0640, got %o", info.Mode().Perm())
+		}
+	})
+
+	t.Run("existing mode is kept", func(t *testing.T) {
+		target := newTestTarget(t, "out", "")
+		if err := os.WriteFile(target.config.OutputPath, []byte("old"), 0o600); err != nil {
+			t.Fatalf("failed to write output: %v", err)
+		}
+		if err := os.Chmod(target.config.OutputPath, 0o600); err != nil {
+			t.Fatalf("failed to chmod output: %v", err)
+		}
+
+		if err := write(t, target, "new"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		info, err := os.Stat(target.config.OutputPath)
+		if err != nil {
+			t.Fatalf("failed to stat output: %v", err)
+		}
+		if info.Mode().Perm() != 0o600 {
+			t.Errorf("expected mode 0600, got %o", info.Mode().Perm())
+		}
+	})
+}
+
+func TestNewOutputOwnership(t *testing.T) {
+	uid := strconv.Itoa(os.Getuid())
+
+	tests := []struct {
+		name    string
+		cfg     TargetConfig
+		wantErr bool
+	}{
+		{"unset", TargetConfig{}, false},
+		{"octal mode", TargetConfig{OutputMode: "0644"}, false},
+		{"invalid mode", TargetConfig{OutputMode: "0999"}, true},
+		{"numeric owner", TargetConfig{OutputOwner: uid, OutputGroup: strconv.Itoa(os.Getgid())}, false},
+		{"unknown owner", TargetConfig{OutputOwner: "no-such-user-k8s-watcher"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newOutputOwnership(tt.cfg)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("expected error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
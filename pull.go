@@ -0,0 +1,116 @@
+// Copyright 2025 Fredrik Steen <fredrik@tty.se>
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// appliedOutput is the last applied state of a target, served to pulling
+// hosts without t.mu
+type appliedOutput struct {
+	Hash   string
+	Data   NodeData
+	Output []byte
+}
+
+// Formats of the nodes endpoint
+const (
+	formatJSON = "json" // NodeData as JSON
+	formatText = "text" // one address per line
+)
+
+// handleOutput serves the last applied output of a target. The ETag covers
+// the output itself, it can change without the node data hash, for example
+// after a template change.
+func (w *Watcher) handleOutput(rw http.ResponseWriter, r *http.Request) {
+	applied := w.appliedOutput(rw, r)
+	if applied == nil {
+		return
+	}
+	sum := sha256.Sum256(applied.Output)
+	etag := fmt.Sprintf(`"%s-%x"`, applied.Hash, sum[:8])
+	serveTagged(rw, r, "text/plain; charset=utf-8", etag, applied.Output)
+}
+
+// handleNodes serves the node data of the last apply of a target, as JSON
+// or with format=text one address per line
+func (w *Watcher) handleNodes(rw http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = formatJSON
+	}
+	if format != formatJSON && format != formatText {
+		http.Error(rw, fmt.Sprintf("unknown format %q, must be %s or %s", format, formatJSON, formatText), http.StatusBadRequest)
+		return
+	}
+
+	applied := w.appliedOutput(rw, r)
+	if applied == nil {
+		return
+	}
+
+	var body []byte
+	contentType := "application/json"
+	if format == formatText {
+		contentType = "text/plain; charset=utf-8"
+		for _, ip := range applied.Data.AllIPs {
+			body = append(body, ip+"\n"...)
+		}
+	} else {
+		b, err := json.MarshalIndent(applied.Data, "", "  ")
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		body = append(b, '\n')
+	}
+
+	// The body also holds node fields not in the hash, see hashFields
+	sum := sha256.Sum256(body)
+	serveTagged(rw, r, contentType, fmt.Sprintf(`"%x"`, sum[:16]), body)
+}
+
+// appliedOutput returns the applied state of the target in the path. Writes
+// an error and returns nil for an unknown or not yet applied target.
+func (w *Watcher) appliedOutput(rw http.ResponseWriter, r *http.Request) *appliedOutput {
+	name := r.PathValue("target")
+	t := w.target(name)
+	if t == nil {
+		http.Error(rw, fmt.Sprintf("unknown target %q", name), http.StatusNotFound)
+		return nil
+	}
+
+	applied := t.applied.Load()
+	if applied == nil {
+		http.Error(rw, fmt.Sprintf("target %q not applied yet", name), http.StatusServiceUnavailable)
+		return nil
+	}
+	return applied
+}
+
+// serveTagged writes body with its ETag, or 304 if the client already has it
+func serveTagged(rw http.ResponseWriter, r *http.Request, contentType, etag string, body []byte) {
+	rw.Header().Set("ETag", etag)
+	rw.Header().Set("Cache-Control", "no-cache")
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		rw.WriteHeader(http.StatusNotModified)
+		return
+	}
+	rw.Header().Set("Content-Type", contentType)
+	rw.Write(body)
+}
+
+// etagMatches reports whether an If-None-Match header matches the ETag
+func etagMatches(header, etag string) bool {
+	for tag := range strings.SplitSeq(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPullEndpoints(t *testing.T) {
+	target := newTestTarget(t, "ips", "{{ range .AllIPs }}allow {{ . }};\n{{ end }}")
+	w := newTestWatcher(target)
+	defer w.queue.ShutDown()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /targets/{target}/output", w.handleOutput)
+	mux.HandleFunc("GET /targets/{target}/nodes", w.handleNodes)
+
+	get := func(path, etag string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := get("/targets/ips/output", ""); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 before the first apply, got %d", rec.Code)
+	}
+	if rec := get("/targets/missing/output", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown target, got %d", rec.Code)
+	}
+
+	w.handleNodeEvent("ADD", newTestNode("node1", "1.2.3.4"))
+	w.handleNodeEvent("ADD", newTestNode("node2", "5.6.7.8"))
+	processQueue(w)
+
+	rec := get("/targets/ips/output", "")
+	if rec.Code != http.StatusOK || rec.Body.String() != "allow 1.2.3.4;\nallow 5.6.7.8;\n" {
+		t.Fatalf("expected rendered output, got %d %q", rec.Code, rec.Body.String())
+	}
+	etag := rec.Header().Get("ETag")
+	if !strings.HasPrefix(etag, `"`+target.status().AppliedHash+"-") {
+		t.Errorf("expected ETag from the applied hash, got %s", etag)
+	}
+
+	if rec := get("/targets/ips/output", etag); rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+		t.Errorf("expected 304 for the current ETag, got %d", rec.Code)
+	}
+
+	rec = get("/targets/ips/nodes?format=text", "")
+	if rec.Code != http.StatusOK || rec.Body.String() != "1.2.3.4\n5.6.7.8\n" {
+		t.Errorf("expected one address per line, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	rec = get("/targets/ips/nodes", "")
+	var data NodeData
+	if err := json.Unmarshal(rec.Body.Bytes(), &data); err != nil {
+		t.Fatalf("failed to parse node data: %v", err)
+	}
+	if len(data.Nodes) != 2 || len(data.AllIPs) != 2 {
+		t.Errorf("expected 2 nodes, got %+v", data)
+	}
+	if body := rec.Body.String(); !strings.Contains(body, `"allIPs"`) || !strings.Contains(body, `"externalIP"`) {
+		t.Errorf("expected lowercase JSON keys, got %s", body)
+	}
+
+	if rec := get("/targets/ips/nodes?format=xml", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown format, got %d", rec.Code)
+	}
+
+	nodesTag := get("/targets/ips/nodes", "").Header().Get("ETag")
+	if rec := get("/targets/ips/nodes", nodesTag); rec.Code != http.StatusNotModified {
+		t.Errorf("expected 304 for the current node data ETag, got %d", rec.Code)
+	}
+
+	// Same node data hash with a different output, as after a template change
+	applied := *target.applied.Load()
+	applied.Output = []byte("deny all;\n")
+	target.applied.Store(&applied)
+	rec = get("/targets/ips/output", etag)
+	if rec.Code != http.StatusOK || rec.Body.String() != "deny all;\n" || rec.Header().Get("ETag") == etag {
+		t.Errorf("expected new output for the same hash, got %d %q with ETag %s", rec.Code, rec.Body.String(), rec.Header().Get("ETag"))
+	}
+
+	// Node metadata not in the hash
+	applied.Data.Nodes[0].Zone = "zone-b"
+	target.applied.Store(&applied)
+	if rec := get("/targets/ips/nodes", nodesTag); rec.Code != http.StatusOK {
+		t.Errorf("expected new node data for the same hash, got %d", rec.Code)
+	}
+
+	// A change gets a new ETag
+	w.handleNodeEvent("DELETE", newTestNode("node2", "5.6.7.8"))
+	processQueue(w)
+	if rec := get("/targets/ips/output", etag); rec.Code != http.StatusOK || rec.Header().Get("ETag") == etag {
+		t.Errorf("expected new output after a change, got %d with ETag %s", rec.Code, rec.Header().Get("ETag"))
+	}
+}
+
+func TestETagMatches(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"", false},
+		{`"abc"`, true},
+		{`W/"abc"`, true},
+		{`"xyz", "abc"`, true},
+		{`"xyz"`, false},
+		{"*", true},
+	}
+	for _, tt := range tests {
+		if got := etagMatches(tt.header, `"abc"`); got != tt.want {
+			t.Errorf("etagMatches(%q) = %t, expected %t", tt.header, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,294 @@
+// Copyright 2025 Fredrik Steen <fredrik@tty.se>
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// targetStatus is the apply state of a target, readable while an apply runs
+type targetStatus struct {
+	DesiredHash   string
+	AppliedHash   string
+	LastApplied   time.Time
+	LastRender    time.Time
+	RenderResult  string // success or failure
+	LastCommand   time.Time
+	CommandResult string    // success or failure
+	PendingSince  time.Time // first queued change not applied yet, zero when up to date
+	LastError     string
+}
+
+// status returns the apply state of the target
+func (t *Target) status() targetStatus {
+	t.statusMu.Lock()
+	defer t.statusMu.Unlock()
+	return t.state
+}
+
+// updateStatus changes the apply state of the target
+func (t *Target) updateStatus(update func(*targetStatus)) {
+	t.statusMu.Lock()
+	defer t.statusMu.Unlock()
+	update(&t.state)
+}
+
+// observeRender counts a render and records it in the status
+func (t *Target) observeRender(result string) {
+	rendersTotal.WithLabelValues(t.config.Name, result).Inc()
+	t.updateStatus(func(s *targetStatus) {
+		s.LastRender = time.Now()
+		s.RenderResult = result
+	})
+}
+
+// observeCommand counts a command execution and records it in the status
+func (t *Target) observeCommand(result string) {
+	commandExecutionsTotal.WithLabelValues(t.config.Name, result).Inc()
+	t.updateStatus(func(s *targetStatus) {
+		s.LastCommand = time.Now()
+		s.CommandResult = result
+	})
+}
+
+// statusResponse is the document served by /status
+type statusResponse struct {
+	Version string           `json:"version"`
+	Synced  bool             `json:"synced"`
+	Paused  bool             `json:"paused"`
+	NodeIPs []string         `json:"nodeIPs"` // addresses of every node
+	Nodes   []nodeStatus     `json:"nodes"`
+	Targets []targetResponse `json:"targets"`
+	Config  configSummary    `json:"config"`
+}
+
+// nodeStatus is a node in the watcher state
+type nodeStatus struct {
+	Name      string   `json:"name"`
+	Addresses []string `json:"addresses"`
+	Draining  bool     `json:"draining,omitempty"`
+}
+
+// targetResponse is the state of a target in /status
+type targetResponse struct {
+	Name          string    `json:"name"`
+	OutputPath    string    `json:"outputPath,omitempty"`
+	StaticIPs     []string  `json:"staticIPs"`
+	DesiredHash   string    `json:"desiredHash"`
+	AppliedHash   string    `json:"appliedHash"`
+	LastApplied   time.Time `json:"lastApplied"`
+	LastRender    time.Time `json:"lastRender"`
+	RenderResult  string    `json:"renderResult"`
+	LastCommand   time.Time `json:"lastCommand"`
+	CommandResult string    `json:"commandResult"`
+	PendingSince  time.Time `json:"pendingSince"`
+	LastError     string    `json:"lastError,omitempty"`
+	Retries       int       `json:"retries"`               // failed applies of the pending change
+	HeldRemoval   []string  `json:"heldRemoval,omitempty"` // nodes of a removal held by the removal guard
+}
+
+// configSummary is the configuration in /status
+type configSummary struct {
+	AddressTypes   []string `json:"addressTypes"`
+	LabelSelector  string   `json:"labelSelector,omitempty"`
+	FieldSelector  string   `json:"fieldSelector,omitempty"`
+	ResyncInterval int      `json:"resyncInterval"`
+	Readiness      bool     `json:"readiness"`
+	QuietPeriod    int      `json:"quietPeriod"`
+	RemovalDelay   int      `json:"removalDelay"`
+	AddDelay       int      `json:"addDelay"`
+}
+
+// status returns the current state of the watcher
+func (w *Watcher) status() statusResponse {
+	resp := statusResponse{
+		Version: version,
+		Synced:  w.synced.Load(),
+		Paused:  w.paused.Load(),
+		NodeIPs: []string{},
+		Nodes:   []nodeStatus{},
+		Config: configSummary{
+			LabelSelector:  w.config.NodeSelector.LabelSelector,
+			FieldSelector:  w.config.NodeSelector.FieldSelector,
+			ResyncInterval: w.config.ResyncInterval,
+			Readiness:      w.config.Readiness.Enabled,
+			QuietPeriod:    w.config.Debounce.QuietPeriod,
+			RemovalDelay:   w.config.Dampening.RemovalDelay,
+			AddDelay:       w.config.Dampening.AddDelay,
+		},
+	}
+	for _, addrType := range w.config.addressTypes() {
+		resp.Config.AddressTypes = append(resp.Config.AddressTypes, string(addrType))
+	}
+
+	w.mu.RLock()
+	for _, node := range w.nodes {
+		resp.Nodes = append(resp.Nodes, nodeStatus{
+			Name:      node.Name,
+			Addresses: node.Addresses,
+			Draining:  node.Draining,
+		})
+		resp.NodeIPs = append(resp.NodeIPs, node.Addresses...)
+	}
+	w.mu.RUnlock()
+
+	slices.SortFunc(resp.Nodes, func(a, b nodeStatus) int { return strings.Compare(a.Name, b.Name) })
+	slices.SortFunc(resp.NodeIPs, compareIPs)
+	resp.NodeIPs = slices.Compact(resp.NodeIPs)
+
+	for _, t := range w.targets {
+		s := t.status()
+		staticIPs := t.config.StaticIPs
+		if staticIPs == nil {
+			staticIPs = []string{}
+		}
+		var held []string
+		if key := removalKey(&t.heldRemoval); key != "" {
+			held = strings.Split(key, ",")
+		}
+		resp.Targets = append(resp.Targets, targetResponse{
+			Name:          t.config.Name,
+			OutputPath:    t.config.OutputPath,
+			StaticIPs:     staticIPs,
+			DesiredHash:   s.DesiredHash,
+			AppliedHash:   s.AppliedHash,
+			LastApplied:   s.LastApplied,
+			LastRender:    s.LastRender,
+			RenderResult:  s.RenderResult,
+			LastCommand:   s.LastCommand,
+			CommandResult: s.CommandResult,
+			PendingSince:  s.PendingSince,
+			LastError:     s.LastError,
+			Retries:       w.queue.NumRequeues(t.config.Name),
+			HeldRemoval:   held,
+		})
+	}
+
+	return resp
+}
+
+// handleStatus serves the watcher state as JSON
+func (w *Watcher) handleStatus(rw http.ResponseWriter, r *http.Request) {
+	b, err := json.MarshalIndent(w.status(), "", "  ")
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(append(b, '\n'))
+}
+
+// runStatus implements the status subcommand, querying /status of a running
+// watcher and printing it
+func runStatus(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("status", flag.ContinueOnError)
+	configFile := flags.String("config", "config.yaml", "Path to configuration file, for the metrics address")
+	addr := flags.String("addr", "", "Address of the watcher (default: metricsAddr from the config)")
+	asJSON := flags.Bool("json", false, "Print the raw JSON status")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *addr == "" {
+		cfg, err := loadConfig(*configFile, "", "", "", "", "")
+		if err != nil {
+			return fmt.Errorf("load configuration: %w", err)
+		}
+		*addr = cfg.MetricsAddr
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get("http://" + *addr + "/status")
+	if err != nil {
+		return fmt.Errorf("query status: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("read status: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("query status: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	if *asJSON {
+		_, err := out.Write(body)
+		return err
+	}
+
+	var status statusResponse
+	if err := json.Unmarshal(body, &status); err != nil {
+		return fmt.Errorf("parse status: %w", err)
+	}
+	return printStatus(out, status)
+}
+
+// printStatus prints the watcher state in a human readable form
+func printStatus(out io.Writer, s statusResponse) error {
+	formatTime := func(t time.Time) string {
+		if t.IsZero() {
+			return "never"
+		}
+		return fmt.Sprintf("%s (%s ago)", t.Format(time.RFC3339), time.Since(t).Round(time.Second))
+	}
+
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Version:\t%s\n", s.Version)
+	fmt.Fprintf(tw, "Cache synced:\t%t\n", s.Synced)
+	if s.Paused {
+		fmt.Fprintf(tw, "Applying:\tpaused\n")
+	}
+	fmt.Fprintf(tw, "Address types:\t%s\n", strings.Join(s.Config.AddressTypes, ", "))
+	if s.Config.LabelSelector != "" {
+		fmt.Fprintf(tw, "Label selector:\t%s\n", s.Config.LabelSelector)
+	}
+	if s.Config.FieldSelector != "" {
+		fmt.Fprintf(tw, "Field selector:\t%s\n", s.Config.FieldSelector)
+	}
+	fmt.Fprintf(tw, "Nodes:\t%d\n", len(s.Nodes))
+	for _, node := range s.Nodes {
+		draining := ""
+		if node.Draining {
+			draining = " (draining)"
+		}
+		fmt.Fprintf(tw, "  %s\t%s%s\n", node.Name, strings.Join(node.Addresses, ", "), draining)
+	}
+
+	for _, t := range s.Targets {
+		state := "up to date"
+		if t.DesiredHash != t.AppliedHash || !t.PendingSince.IsZero() {
+			state = "pending"
+		}
+		fmt.Fprintf(tw, "\nTarget %s:\t%s\n", t.Name, state)
+		if t.OutputPath != "" {
+			fmt.Fprintf(tw, "  Output:\t%s\n", t.OutputPath)
+		}
+		if len(t.StaticIPs) > 0 {
+			fmt.Fprintf(tw, "  Static IPs:\t%s\n", strings.Join(t.StaticIPs, ", "))
+		}
+		fmt.Fprintf(tw, "  Applied hash:\t%.12s\n", t.AppliedHash)
+		fmt.Fprintf(tw, "  Desired hash:\t%.12s\n", t.DesiredHash)
+		fmt.Fprintf(tw, "  Last applied:\t%s\n", formatTime(t.LastApplied))
+		fmt.Fprintf(tw, "  Last render:\t%s %s\n", formatTime(t.LastRender), t.RenderResult)
+		fmt.Fprintf(tw, "  Last command:\t%s %s\n", formatTime(t.LastCommand), t.CommandResult)
+		if !t.PendingSince.IsZero() {
+			fmt.Fprintf(tw, "  Pending since:\t%s, %d retries\n", formatTime(t.PendingSince), t.Retries)
+		}
+		if len(t.HeldRemoval) > 0 {
+			fmt.Fprintf(tw, "  Held removal:\t%s\n", strings.Join(t.HeldRemoval, ", "))
+		}
+		if t.LastError != "" {
+			fmt.Fprintf(tw, "  Last error:\t%s\n", t.LastError)
+		}
+	}
+
+	return tw.Flush()
+}
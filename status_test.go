@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandleStatus(t *testing.T) {
+	target := newTestTarget(t, "ips", "{{ len .Nodes }}")
+	target.config.StaticIPs = []string{"192.0.2.1"}
+	w := newTestWatcher(target)
+	defer w.queue.ShutDown()
+
+	w.handleNodeEvent("ADD", newTestNode("node2", "10.0.0.2"))
+	w.handleNodeEvent("ADD", newTestNode("node1", "10.0.0.1"))
+	processQueue(w)
+
+	rec := httptest.NewRecorder()
+	w.handleStatus(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+
+	var status statusResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatalf("failed to parse status: %v", err)
+	}
+
+	if got := strings.Join(status.NodeIPs, ","); got != "10.0.0.1,10.0.0.2" {
+		t.Errorf("expected sorted node IPs, got %s", got)
+	}
+	if len(status.Nodes) != 2 || status.Nodes[0].Name != "node1" {
+		t.Errorf("expected nodes sorted by name, got %+v", status.Nodes)
+	}
+	if len(status.Targets) != 1 {
+		t.Fatalf("expected 1 target, got %d", len(status.Targets))
+	}
+	ts := status.Targets[0]
+	if ts.AppliedHash == "" || ts.AppliedHash != ts.DesiredHash {
+		t.Errorf("expected applied hash to match desired hash, got %q and %q", ts.AppliedHash, ts.DesiredHash)
+	}
+	if ts.RenderResult != "success" || ts.LastRender.IsZero() || ts.LastApplied.IsZero() {
+		t.Errorf("expected a successful render, got %+v", ts)
+	}
+	if len(ts.StaticIPs) != 1 || ts.StaticIPs[0] != "192.0.2.1" {
+		t.Errorf("expected static IPs, got %v", ts.StaticIPs)
+	}
+}
+
+func TestRunStatus(t *testing.T) {
+	target := newTestTarget(t, "ips", "{{ len .Nodes }}")
+	setCommand(t, target, "/bin/false")
+	w := newTestWatcher(target)
+	defer w.queue.ShutDown()
+
+	w.handleNodeEvent("ADD", newTestNode("node1", "10.0.0.1"))
+	processQueue(w)
+
+	srv := httptest.NewServer(http.HandlerFunc(w.handleStatus))
+	defer srv.Close()
+	addr := strings.TrimPrefix(srv.URL, "http://")
+
+	var out strings.Builder
+	if err := runStatus([]string{"-addr", addr}, &out); err != nil {
+		t.Fatalf("status failed: %v", err)
+	}
+	for _, want := range []string{"node1", "10.0.0.1", "Target ips:", "pending", "failure", "Last error:"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("expected output to contain %q, got:\n%s", want, out.String())
+		}
+	}
+
+	out.Reset()
+	if err := runStatus([]string{"-addr", addr, "-json"}, &out); err != nil {
+		t.Fatalf("status -json failed: %v", err)
+	}
+	if !json.Valid([]byte(out.String())) {
+		t.Errorf("expected JSON output, got:\n%s", out.String())
+	}
+}